@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+// apiKeyUseResolution is how precise the last use of a key is, saving a write
+// on every request.
+const apiKeyUseResolution = time.Minute
+
+// APIKey lets machine integrations, such as the accounting spreadsheet, read
+// data without borrowing the token of an admin.
+type APIKey struct {
+	bun.BaseModel `bun:"table:api_keys"`
+
+	ID              string     `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	Name            string     `bun:"name,notnull"`
+	KeyHash         string     `bun:"key_hash,unique,notnull"`
+	Prefix          string     `bun:"prefix,notnull"`
+	Scopes          []string   `bun:"scopes,array,notnull"`
+	CreatedByUserID string     `bun:"created_by_user_id,notnull"`
+	CreatedAt       time.Time  `bun:"created_at,notnull,default:current_timestamp"`
+	ExpiresAt       *time.Time `bun:"expires_at"`
+	RevokedAt       *time.Time `bun:"revoked_at"`
+	LastUsedAt      *time.Time `bun:"last_used_at"`
+
+	CreatedBy *User `bun:"rel:belongs-to,join:created_by_user_id=id"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type APIKeyResponseItem struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  *time.Time `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	// Key is only returned when it is created.
+	Key *string `json:"key,omitempty"`
+}
+
+func newAPIKeyResponseItem(apiKey *APIKey) *APIKeyResponseItem {
+	item := &APIKeyResponseItem{
+		ID:         apiKey.ID,
+		Name:       apiKey.Name,
+		Prefix:     apiKey.Prefix,
+		Scopes:     apiKey.Scopes,
+		CreatedAt:  apiKey.CreatedAt,
+		ExpiresAt:  apiKey.ExpiresAt,
+		RevokedAt:  apiKey.RevokedAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+	if apiKey.CreatedBy != nil {
+		item.CreatedBy = apiKey.CreatedBy.Email
+	}
+
+	return item
+}
+
+// apiKeyValidator grants the scopes of the key which its creator still has:
+// removing the roles of an admin disables their keys.
+func apiKeyValidator(db *bun.DB) auth.APIKeyValidator {
+	return func(ctx context.Context, key string) (*auth.APIKey, error) {
+		apiKey := new(APIKey)
+		err := db.NewSelect().Model(apiKey).Relation("CreatedBy").Where("key_hash = ?", auth.HashToken(key)).Where("revoked_at IS NULL").Where("expires_at IS NULL OR expires_at > now()").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, auth.ErrAPIKeyInvalid
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		creatorPermissions := rolesPermissionsOf(apiKey.CreatedBy.Roles)
+		permissions := make([]string, 0, len(apiKey.Scopes))
+		for _, scope := range apiKey.Scopes {
+			if containsString(creatorPermissions, scope) {
+				permissions = append(permissions, scope)
+			}
+		}
+		if len(permissions) == 0 {
+			return nil, auth.ErrAPIKeyInvalid
+		}
+
+		_, err = db.NewUpdate().Table("api_keys").Set("last_used_at = now()").Where("id = ?", apiKey.ID).Where("last_used_at IS NULL OR last_used_at < ?", time.Now().Add(-apiKeyUseResolution)).Exec(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &auth.APIKey{ID: apiKey.ID, UserID: apiKey.CreatedByUserID, Permissions: permissions}, nil
+	}
+}
+
+func registerAPIKeyRoutes(admins *gin.RouterGroup, db *bun.DB) {
+	admins.GET("/api-keys", func(c *gin.Context) {
+		apiKeys := make([]*APIKey, 0)
+		if err := db.NewSelect().Model(&apiKeys).Relation("CreatedBy").Order("api_key.created_at DESC").Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*APIKeyResponseItem, 0, len(apiKeys))
+		for _, apiKey := range apiKeys {
+			response = append(response, newAPIKeyResponseItem(apiKey))
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admins.POST("/api-keys", func(c *gin.Context) {
+		var json CreateAPIKeyRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		// A key is always read-only, and cannot grant more than its creator
+		// has.
+		for _, scope := range json.Scopes {
+			if !auth.HasPermission(c, scope) {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"Unknown scope: " + scope + ".", "scope-invalid"})
+				return
+			}
+		}
+
+		if json.ExpiresAt != nil && json.ExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"The expiry date is in the past.", "expires-at-invalid"})
+			return
+		}
+
+		key, err := auth.NewAPIKey()
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		apiKey := &APIKey{
+			Name:            json.Name,
+			KeyHash:         auth.HashToken(key),
+			Prefix:          key[:len(auth.APIKeyPrefix)+6],
+			Scopes:          json.Scopes,
+			CreatedByUserID: c.GetString("userID"),
+			CreatedAt:       time.Now(),
+			ExpiresAt:       json.ExpiresAt,
+		}
+
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.NewInsert().Model(apiKey).Returning("id").Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, apiKey.CreatedByUserID, c.ClientIP(), "api-key.create", "api-key", apiKey.ID, map[string]interface{}{
+				"name":      apiKey.Name,
+				"scopes":    apiKey.Scopes,
+				"expiresAt": apiKey.ExpiresAt,
+			})
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := newAPIKeyResponseItem(apiKey)
+		response.Key = &key
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admins.DELETE("/api-keys/:apiKeyID", func(c *gin.Context) {
+		apiKeyID := c.Param("apiKeyID")
+
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			result, err := tx.NewUpdate().Table("api_keys").Set("revoked_at = now()").Where("id = ?", apiKeyID).Where("revoked_at IS NULL").Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				return sql.ErrNoRows
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "api-key.revoke", "api-key", apiKeyID, nil)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"API key not found.", "not-found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
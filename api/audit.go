@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+const (
+	// defaultAuditRetention is how long the audit log is kept when
+	// AUDIT_RETENTION_DAYS is not set.
+	defaultAuditRetention = 365 * 24 * time.Hour
+
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 500
+)
+
+// AuditEntry records an action done by an admin or on a sensitive resource.
+// The audit log is append-only: the database refuses to change it, except for
+// the retention policy and the erasure of a member.
+type AuditEntry struct {
+	bun.BaseModel `bun:"table:audit_log"`
+
+	ID          string                 `bun:"id,pk,type:uuid,default:gen_random_uuid()" json:"id"`
+	ActorUserID *string                `bun:"actor_user_id" json:"actorUserId"`
+	Action      string                 `bun:"action,notnull" json:"action"`
+	TargetType  string                 `bun:"target_type,notnull" json:"targetType"`
+	TargetID    string                 `bun:"target_id,notnull" json:"targetId"`
+	IP          *string                `bun:"ip" json:"ip"`
+	Details     map[string]interface{} `bun:"details,type:jsonb,notnull" json:"details"`
+	CreatedAt   time.Time              `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+
+	Actor *User `bun:"rel:belongs-to,join:actor_user_id=id" json:"-"`
+}
+
+type AuditEntryResponseItem struct {
+	*AuditEntry
+	ActorEmail *string `json:"actorEmail"`
+}
+
+// auditedRead is an admin route reading personal data, which is recorded
+// along with the actions.
+type auditedRead struct {
+	action     string
+	targetType string
+	// targetParam is the route parameter holding the target, if any.
+	targetParam string
+}
+
+var auditedReads = map[string]auditedRead{
+	"/admin/csv/users":     {"users.export", "users", ""},
+	"/admin/users":         {"users.list", "users", ""},
+	"/admin/users/:userID": {"user.view", "user", "userID"},
+	"/admin/users/:userID/documents/:documentID": {"document.view", "user", "userID"},
+	"/admin/users/:userID/profile-history":       {"profile-history.view", "user", "userID"},
+	"/admin/users/:userID/erasure":               {"erasure.preview", "user", "userID"},
+	"/admin/gifts":                               {"gifts.list", "gifts", ""},
+	"/admin/gifts/:giftID":                       {"gift.view", "gift", "giftID"},
+	"/admin/audit":                               {"audit.view", "audit", ""},
+}
+
+func writeAudit(ctx context.Context, db bun.IDB, actorUserID, ip, action, targetType, targetID string, details map[string]interface{}) error {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+
+	entry := &AuditEntry{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		Details:    details,
+		CreatedAt:  time.Now(),
+	}
+	if actorUserID != "" {
+		entry.ActorUserID = &actorUserID
+	}
+	if ip != "" {
+		entry.IP = &ip
+	}
+
+	_, err := db.NewInsert().Model(entry).Exec(ctx)
+	return err
+}
+
+// allowAuditMaintenance lets the transaction change the audit log, which the
+// database otherwise refuses.
+func allowAuditMaintenance(ctx context.Context, tx bun.Tx) error {
+	_, err := tx.ExecContext(ctx, "SET LOCAL entrelac.audit_maintenance = 'on'")
+	return err
+}
+
+// auditReads records the admin routes reading personal data, such as who
+// looked at an identity document or exported the members. Failed requests
+// are not recorded, as no data was read.
+func auditReads(db *bun.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		read, ok := auditedReads[c.FullPath()]
+		if !ok || c.Request.Method != http.MethodGet || c.Writer.Status() >= http.StatusBadRequest {
+			return
+		}
+
+		targetID := ""
+		if read.targetParam != "" {
+			targetID = c.Param(read.targetParam)
+		}
+
+		details := map[string]interface{}{}
+		for _, param := range c.Params {
+			if param.Key != read.targetParam {
+				details[param.Key] = param.Value
+			}
+		}
+		// The token of the documents links is not kept.
+		query := c.Request.URL.Query()
+		query.Del("token")
+		if len(query) > 0 {
+			details["query"] = query.Encode()
+		}
+		if apiKeyID := c.GetString("apiKeyID"); apiKeyID != "" {
+			details["apiKeyId"] = apiKeyID
+		}
+
+		if err := writeAudit(c, db, c.GetString("userID"), c.ClientIP(), read.action, read.targetType, targetID, details); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func cleanUpAuditLog(ctx context.Context, db *bun.DB, retention time.Duration) error {
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := allowAuditMaintenance(ctx, tx); err != nil {
+			return err
+		}
+
+		_, err := tx.NewDelete().Table("audit_log").Where("created_at < ?", time.Now().Add(-retention)).Exec(ctx)
+		return err
+	})
+}
+
+func runAuditLogCleanUp(db *bun.DB, retention time.Duration) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := cleanUpAuditLog(context.Background(), db, retention); err != nil {
+			log.Printf("error cleaning up audit log: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
+
+func registerAuditRoutes(admins *gin.RouterGroup, db *bun.DB) {
+	// The entries are given the latest first, a page at a time: the next page
+	// is the one before the creation date of the last entry.
+	admins.GET("/audit", func(c *gin.Context) {
+		entries := make([]*AuditEntry, 0)
+		query := db.NewSelect().Model(&entries).Relation("Actor").Order("audit_entry.created_at DESC")
+
+		if actor := c.Query("actor"); actor != "" {
+			query = query.Where("audit_entry.actor_user_id::text = ? OR actor.email ILIKE ?", actor, "%"+actor+"%")
+		}
+		// An action also filters the actions under it: user gives
+		// user.impersonate and user.erase.
+		if action := c.Query("action"); action != "" {
+			query = query.Where("audit_entry.action = ? OR audit_entry.action LIKE ?", action, action+".%")
+		}
+		if targetType := c.Query("target_type"); targetType != "" {
+			query = query.Where("audit_entry.target_type = ?", targetType)
+		}
+		if targetID := c.Query("target_id"); targetID != "" {
+			query = query.Where("audit_entry.target_id = ?", targetID)
+		}
+		if ip := c.Query("ip"); ip != "" {
+			query = query.Where("audit_entry.ip = ?", ip)
+		}
+
+		for _, filter := range []struct {
+			param string
+			where string
+		}{
+			{"from", "audit_entry.created_at >= ?"},
+			{"to", "audit_entry.created_at <= ?"},
+			{"before", "audit_entry.created_at < ?"},
+		} {
+			value := c.Query(filter.param)
+			if value == "" {
+				continue
+			}
+
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"The date " + filter.param + " is invalid.", filter.param + "-invalid"})
+				return
+			}
+			query = query.Where(filter.where, t)
+		}
+
+		limit := defaultAuditPageSize
+		if value := c.Query("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 || n > maxAuditPageSize {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"The limit is invalid.", "limit-invalid"})
+				return
+			}
+			limit = n
+		}
+
+		if err := query.Limit(limit).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*AuditEntryResponseItem, 0, len(entries))
+		for _, entry := range entries {
+			item := &AuditEntryResponseItem{AuditEntry: entry}
+			if entry.Actor != nil {
+				item.ActorEmail = &entry.Actor.Email
+			}
+			response = append(response, item)
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+}
@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyPrefix starts the API keys, telling them apart from the JWTs.
+const APIKeyPrefix = "entrelac_"
+
+var ErrAPIKeyInvalid = errors.New("API key invalid")
+
+// APIKey is what an API key grants: the permissions it was scoped to, among
+// the ones its creator still has.
+type APIKey struct {
+	ID          string
+	UserID      string
+	Permissions []string
+}
+
+// APIKeyValidator returns ErrAPIKeyInvalid if the key is unknown, expired or
+// revoked.
+type APIKeyValidator func(ctx context.Context, key string) (*APIKey, error)
+
+func NewAPIKey() (string, error) {
+	secret, err := NewSecret()
+	if err != nil {
+		return "", err
+	}
+
+	return APIKeyPrefix + secret, nil
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// authenticateAPIKey lets machine integrations read data with an API key
+// instead of a JWT. They can only read, and only from the admin routes.
+func authenticateAPIKey(c *gin.Context, validateAPIKey APIKeyValidator, token string) {
+	apiKey, err := validateAPIKey(c, token)
+	if errors.Is(err, ErrAPIKeyInvalid) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"error": "The API key is invalid.",
+			"code":  "api-key-invalid",
+		})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"error": "Internal server error.",
+			"code":  "internal",
+		})
+		return
+	}
+
+	if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "API keys can only read data.",
+			"code":  "api-key-read-only",
+		})
+		return
+	}
+
+	// The key acts for its creator, whose own account, such as their
+	// sessions or their second factor, must stay out of its reach.
+	if !strings.HasPrefix(c.FullPath(), "/admin/") {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "API keys can only call the admin routes.",
+			"code":  "api-key-admin-only",
+		})
+		return
+	}
+
+	c.Set("apiKeyID", apiKey.ID)
+	c.Set("userID", apiKey.UserID)
+	c.Set("permissions", apiKey.Permissions)
+	// The key was created from a session opened with a second factor.
+	c.Set("mfa", true)
+	c.Next()
+}
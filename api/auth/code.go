@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const ConfirmTokenDuration = 48 * time.Hour
+
+const ResetTokenDuration = time.Hour
+
+const EmailChangeTokenDuration = time.Hour
+
+func newCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		panic(err)
+	}
+
+	return fmt.Sprintf("%06d", n)
+}
+
+// HashCode hashes a code sent by email before storing it. The codes being
+// short, the hash is keyed so that it cannot be reversed without the key.
+func HashCode(key []byte, code string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("code\x00" + code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckCode(key []byte, code, hash string) bool {
+	return hmac.Equal([]byte(HashCode(key, code)), []byte(hash))
+}
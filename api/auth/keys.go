@@ -0,0 +1,266 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// SigningKey is an RSA or Ed25519 key signing our tokens, which anyone can
+// verify with the public key published as a JWK.
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// KeySet holds the keys verifying our tokens. The last one, in the order of
+// the file names, signs the new tokens.
+//
+// To rotate the keys, add a new key whose file name sorts last, for instance
+// named after the current date, and restart. The previous key keeps verifying
+// the tokens it signed: it can be removed once they have all expired.
+type KeySet struct {
+	keys []*SigningKey
+}
+
+var ErrKeyUnknown = errors.New("signing key unknown")
+
+func newSigningKey(private crypto.Signer) (*SigningKey, error) {
+	var method jwt.SigningMethod
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(private.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(der)
+
+	return &SigningKey{
+		ID:      base64.RawURLEncoding.EncodeToString(sum[:16]),
+		Method:  method,
+		Private: private,
+	}, nil
+}
+
+// loadSigningKey reads a PEM encoded private key, either a PKCS #1 RSA key or
+// a PKCS #8 RSA or Ed25519 key.
+func loadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %s", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, private)
+	}
+
+	return newSigningKey(signer)
+}
+
+// generateSigningKey writes a new RSA key: RS256 is the only algorithm every
+// OpenID Connect client supports.
+func generateSigningKey(path string) (*SigningKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	return newSigningKey(private)
+}
+
+// LoadKeySet reads the *.pem keys of the directory, generating one the first
+// time.
+func LoadKeySet(dir string) (*KeySet, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keySet := new(KeySet)
+	for _, path := range paths {
+		key, err := loadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+
+		keySet.keys = append(keySet.keys, key)
+	}
+
+	if len(keySet.keys) == 0 {
+		key, err := generateSigningKey(filepath.Join(dir, time.Now().Format("2006-01-02")+".pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		keySet.keys = append(keySet.keys, key)
+	}
+
+	return keySet, nil
+}
+
+func (keySet *KeySet) signingKey() *SigningKey {
+	return keySet.keys[len(keySet.keys)-1]
+}
+
+// Algorithms returns the algorithms of the keys, without duplicates.
+func (keySet *KeySet) Algorithms() []string {
+	algorithms := make([]string, 0, len(keySet.keys))
+	for _, key := range keySet.keys {
+		alg := key.Method.Alg()
+		if !containsString(algorithms, alg) {
+			algorithms = append(algorithms, alg)
+		}
+	}
+
+	return algorithms
+}
+
+func (keySet *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: make([]JWK, 0, len(keySet.keys))}
+	for _, key := range keySet.keys {
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+
+	return jwks
+}
+
+func (keySet *KeySet) Sign(claims jwt.Claims) (string, error) {
+	key := keySet.signingKey()
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
+}
+
+// Parse checks a token signed by one of the keys, filling claims.
+func (keySet *KeySet) Parse(token string, claims jwt.Claims) error {
+	parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		for _, key := range keySet.keys {
+			if key.ID == kid {
+				// The algorithm comes from the token: it must be the one
+				// of the key.
+				if token.Method.Alg() != key.Method.Alg() {
+					return nil, ErrTokenInvalid
+				}
+
+				return key.Private.Public(), nil
+			}
+		}
+
+		return nil, ErrKeyUnknown
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+	if err != nil {
+		return err
+	}
+
+	if !parsedToken.Valid {
+		return ErrTokenInvalid
+	}
+
+	return nil
+}
+
+func (key *SigningKey) JWK() JWK {
+	jwk := JWK{
+		Use: "sig",
+		Alg: key.Method.Alg(),
+		Kid: key.ID,
+	}
+
+	switch public := key.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strings"
@@ -10,7 +11,7 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func Middleware(key []byte) gin.HandlerFunc {
+func Middleware(keys *KeySet, validateSession SessionValidator, validateAPIKey APIKeyValidator) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token := c.Query("token")
 		if token == "" {
@@ -34,30 +35,46 @@ func Middleware(key []byte) gin.HandlerFunc {
 			token = authorization[7:]
 		}
 
-		parsedToken, err := jwt.ParseWithClaims(token, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-			return key, nil
-		})
-		if parsedToken.Valid {
-			if claims, ok := parsedToken.Claims.(*CustomClaims); ok {
-				c.Set("userID", claims.UserID)
-				c.Set("admin", claims.Admin)
-				sentry.ConfigureScope(func(scope *sentry.Scope) {
-					scope.SetUser(sentry.User{ID: claims.UserID})
-				})
-				c.Next()
-			} else {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-					"error": "The token is invalid.",
-					"code":  "token-invalid",
-				})
+		if IsAPIKey(token) {
+			authenticateAPIKey(c, validateAPIKey, token)
+			return
+		}
+
+		claims, err := ParseToken(keys, token)
+		if err == nil {
+			if err := CheckSession(c, validateSession, claims); err != nil {
+				if errors.Is(err, ErrSessionRevoked) {
+					c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+						"error": "The session has been revoked.",
+						"code":  "session-revoked",
+					})
+				} else {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+						"error": "Internal server error.",
+						"code":  "internal",
+					})
+				}
+				return
 			}
-		} else if errors.Is(err, jwt.ErrTokenMalformed) || errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+
+			c.Set("sessionID", claims.SessionID)
+			c.Set("userID", claims.UserID)
+			c.Set("permissions", claims.Permissions)
+			c.Set("mfa", claims.MFA)
+			c.Set("impersonatorID", claims.ImpersonatorID)
+			sentry.ConfigureScope(func(scope *sentry.Scope) {
+				scope.SetUser(sentry.User{ID: claims.UserID})
+			})
+			c.Next()
+		} else if errors.Is(err, ErrTokenInvalid) || errors.Is(err, jwt.ErrTokenMalformed) || errors.Is(err, jwt.ErrTokenSignatureInvalid) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"error": "The token is invalid.",
 				"code":  "token-invalid",
 			})
 			return
-		} else if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) {
+		} else if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) || errors.Is(err, ErrKeyUnknown) {
+			// A token signed by a key which was rotated out is refreshed
+			// like an expired one, instead of logging the user out.
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
 				"error": "The token has expired.",
 				"code":  "token-expired",
@@ -72,11 +89,36 @@ func Middleware(key []byte) gin.HandlerFunc {
 	}
 }
 
+// CheckSession returns ErrSessionRevoked if the token does not belong to a
+// valid session. Tokens issued before sessions existed have none.
+func CheckSession(ctx context.Context, validateSession SessionValidator, claims *CustomClaims) error {
+	if claims.SessionID == "" {
+		return ErrSessionRevoked
+	}
+
+	return validateSession(ctx, claims.SessionID)
+}
+
+// RequestToken returns the token given in the query or in the Authorization
+// header of the request, if any.
+func RequestToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+
+	authorization := c.GetHeader("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+
+	return authorization[7:]
+}
+
+// AdminMiddleware restricts the admin routes to the users holding a role.
+// Each group of routes then requires its own permission.
 func AdminMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		admin := c.GetBool("admin")
-
-		if !admin {
+		if len(c.GetStringSlice("permissions")) == 0 {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "You must be admin to call this route.",
 				"code":  "not-admin",
@@ -84,6 +126,33 @@ func AdminMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// Admins can see the documents of every member: their session must
+		// have been opened with a second factor.
+		if !c.GetBool("mfa") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "Two-factor authentication is required to call this route.",
+				"code":  "mfa-required",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ImpersonationMiddleware keeps the admins seeing the app as a member from
+// acting on their behalf: paying, changing their credentials, or anything
+// else but reading.
+func ImpersonationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("impersonatorID") != "" && c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "This action is not allowed while impersonating a user.",
+				"code":  "impersonating",
+			})
+			return
+		}
+
 		c.Next()
 	}
 }
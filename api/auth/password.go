@@ -1,15 +1,143 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Argon2Params tunes the cost of argon2id. They are stored in every hash, so
+// that changing them only applies to the new hashes.
+type Argon2Params struct {
+	// Memory is in KiB.
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// PasswordParams are the parameters of the new hashes, following the OWASP
+// recommendations for a small server.
+var PasswordParams = Argon2Params{
+	Memory:     64 * 1024,
+	Time:       3,
+	Threads:    2,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+var errHashInvalid = errors.New("password hash invalid")
+
+// Validate returns an error if argon2id would panic with the parameters,
+// which it does when the time or the threads are zero, or when the memory is
+// less than 8 KiB per thread.
+func (params *Argon2Params) Validate() error {
+	switch {
+	case params.Time < 1:
+		return errors.New("the time must be at least 1")
+	case params.Threads < 1:
+		return errors.New("the threads must be at least 1")
+	case params.Memory < 8*uint32(params.Threads):
+		return fmt.Errorf("the memory must be at least %d KiB", 8*uint32(params.Threads))
+	}
+
+	return nil
+}
+
+// HashPassword hashes the password with argon2id, in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-	return string(bytes), err
+	params := PasswordParams
+
+	salt := make([]byte, params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
 }
 
+func decodeArgon2Hash(hash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, errHashInvalid
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, errHashInvalid
+	}
+
+	params := new(Argon2Params)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, errHashInvalid
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errHashInvalid
+	}
+	params.SaltLength = uint32(len(salt))
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, errHashInvalid
+	}
+	params.KeyLength = uint32(len(key))
+
+	// An empty key would match any password.
+	if params.KeyLength == 0 || params.Validate() != nil {
+		return nil, nil, nil, errHashInvalid
+	}
+
+	return params, salt, key, nil
+}
+
+// CheckPassword checks the password against an argon2id hash, or a bcrypt one
+// made before argon2id was used. A password longer than MaxPasswordLength is
+// refused without hashing it, as no such password can be set.
 func CheckPassword(password, hash string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-	return err == nil
+	if len(password) > MaxPasswordLength {
+		return false
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		return err == nil
+	}
+
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+
+	otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+
+	return subtle.ConstantTimeCompare(key, otherKey) == 1
+}
+
+// NeedsRehash tells whether the hash was made with bcrypt or with other
+// parameters than the current ones. The password is then hashed again on the
+// next login.
+func NeedsRehash(hash string) bool {
+	params, _, _, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return *params != PasswordParams
 }
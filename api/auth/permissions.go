@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The permissions carried by the tokens, granted through the roles of the
+// user.
+const (
+	PermissionViewMembers      = "view-members"
+	PermissionViewDocuments    = "view-documents"
+	PermissionEditMembers      = "edit-members"
+	PermissionRecordPayments   = "record-payments"
+	PermissionManageAssemblies = "manage-assemblies"
+	PermissionManageAdmins     = "manage-admins"
+)
+
+func hasPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (claims *CustomClaims) HasPermission(permission string) bool {
+	return hasPermission(claims.Permissions, permission)
+}
+
+// HasPermission tells whether the token of the request grants the permission.
+func HasPermission(c *gin.Context, permission string) bool {
+	return hasPermission(c.GetStringSlice("permissions"), permission)
+}
+
+// PermissionMiddleware restricts a group of admin routes to the users granted
+// the permission.
+func PermissionMiddleware(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasPermission(c, permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "You are not allowed to call this route.",
+				"code":  "permission-denied",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,338 @@
+package auth
+
+import (
+	_ "embed"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	MinPasswordLength = 10
+	// MaxPasswordLength is in bytes, keeping hashing cheap.
+	MaxPasswordLength = 256
+)
+
+// minPasswordBits is the estimated entropy below which a password is refused.
+const minPasswordBits = 40
+
+// The feedback codes explaining why a password is refused. The app translates
+// them.
+const (
+	PasswordTooShort   = "password-too-short"
+	PasswordTooLong    = "password-too-long"
+	PasswordCommon     = "password-common"
+	PasswordPersonal   = "password-personal"
+	PasswordSequence   = "password-sequence"
+	PasswordRepetitive = "password-repetitive"
+	PasswordWeak       = "password-weak"
+)
+
+// PasswordStrength is the offline estimate of how hard a password is to guess.
+type PasswordStrength struct {
+	// Score goes from 0, trivial to guess, to 4.
+	Score      int      `json:"score"`
+	Acceptable bool     `json:"acceptable"`
+	Feedback   []string `json:"feedback"`
+}
+
+//go:embed common-passwords.txt
+var commonPasswordsFile string
+
+var commonPasswords = loadCommonPasswords()
+
+// commonPasswordWords are the common passwords long enough to be looked for
+// inside longer ones, the longest first.
+var commonPasswordWords = func() []string {
+	var words []string
+	for word := range commonPasswords {
+		if utf8.RuneCountInString(word) >= 4 {
+			words = append(words, word)
+		}
+	}
+	sortLongestFirst(words)
+
+	return words
+}()
+
+// keyboardRows are walked to find sequences such as "azerty" or "qwerty".
+var keyboardRows = []string{
+	"1234567890",
+	"azertyuiop",
+	"qsdfghjklm",
+	"wxcvbn",
+	"qwertyuiop",
+	"asdfghjkl",
+	"zxcvbnm",
+	"abcdefghijklmnopqrstuvwxyz",
+}
+
+var leetReplacer = strings.NewReplacer(
+	"0", "o",
+	"1", "i",
+	"3", "e",
+	"4", "a",
+	"5", "s",
+	"7", "t",
+	"@", "a",
+	"$", "s",
+	"!", "i",
+)
+
+func loadCommonPasswords() map[string]bool {
+	passwords := map[string]bool{}
+	for _, line := range strings.Split(commonPasswordsFile, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			passwords[normalizePassword(line)] = true
+		}
+	}
+
+	return passwords
+}
+
+// normalizePassword lowercases the password and undoes the usual character
+// substitutions, rune for rune so that positions are kept.
+func normalizePassword(password string) string {
+	return leetReplacer.Replace(strings.ToLower(password))
+}
+
+// personalTokens splits the name and email of the member in the words someone
+// knowing them would try. Shorter words would turn up in too many passwords.
+func personalTokens(userInputs []string) []string {
+	var tokens []string
+	for _, input := range userInputs {
+		words := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+
+		for _, word := range words {
+			if utf8.RuneCountInString(word) >= 4 {
+				tokens = append(tokens, normalizePassword(word))
+			}
+		}
+	}
+
+	sortLongestFirst(tokens)
+
+	return tokens
+}
+
+func passwordPoolSize(password string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	size := 0
+	for _, set := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if set.present {
+			size += set.size
+		}
+	}
+
+	return size
+}
+
+// markRuns marks the runs of at least three characters following each other
+// in a keyboard row or the alphabet, in either direction.
+func markRuns(password []rune, marked []bool) bool {
+	found := false
+
+	for _, row := range keyboardRows {
+		for _, sequence := range []string{row, reverse(row)} {
+			for start := 0; start < len(password); {
+				end := start
+				for end+1 < len(password) && strings.Contains(sequence, string(password[start:end+2])) {
+					end++
+				}
+
+				if end-start+1 >= 3 {
+					for i := start; i <= end; i++ {
+						marked[i] = true
+					}
+					found = true
+					start = end + 1
+				} else {
+					start++
+				}
+			}
+		}
+	}
+
+	return found
+}
+
+// markRepeats marks the characters repeating the ones just before them, as in
+// "aaaa" or "abcabc".
+func markRepeats(password []rune, marked []bool) bool {
+	found := false
+
+	for size := 1; size <= len(password)/2; size++ {
+		for i := size; i < len(password); i++ {
+			if password[i] != password[i-size] {
+				continue
+			}
+
+			end := i
+			for end+1 < len(password) && password[end+1] == password[end+1-size] {
+				end++
+			}
+
+			if end-i+1 >= size && end-i+1 >= 2 {
+				for j := i; j <= end; j++ {
+					marked[j] = true
+				}
+				found = true
+			}
+			i = end
+		}
+	}
+
+	return found
+}
+
+// markWords marks the occurrences of the words, returning how many were
+// found. Occurrences within already marked parts are not counted, the words
+// being given the longest first.
+func markWords(password string, words []string, marked []bool) int {
+	found := 0
+
+	for _, word := range words {
+		for offset := 0; ; {
+			index := strings.Index(password[offset:], word)
+			if index < 0 {
+				break
+			}
+
+			start := utf8.RuneCountInString(password[:offset+index])
+			fresh := false
+			for i := 0; i < utf8.RuneCountInString(word); i++ {
+				if !marked[start+i] {
+					marked[start+i] = true
+					fresh = true
+				}
+			}
+			if fresh {
+				found++
+			}
+			offset += index + len(word)
+		}
+	}
+
+	return found
+}
+
+func sortLongestFirst(words []string) {
+	sort.Slice(words, func(i, j int) bool {
+		if len(words[i]) != len(words[j]) {
+			return len(words[i]) > len(words[j])
+		}
+
+		return words[i] < words[j]
+	})
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+
+	return string(runes)
+}
+
+// CheckPasswordStrength estimates the strength of the password, which must not
+// be guessable from the common passwords, nor from userInputs: the name and
+// email address of the member.
+func CheckPasswordStrength(password string, userInputs ...string) *PasswordStrength {
+	strength := &PasswordStrength{Feedback: []string{}}
+
+	tooShort := utf8.RuneCountInString(password) < MinPasswordLength
+	if tooShort {
+		strength.Feedback = append(strength.Feedback, PasswordTooShort)
+	}
+	// A long password is not looked at further, as the checks below cost
+	// time with its length.
+	if len(password) > MaxPasswordLength {
+		strength.Feedback = append(strength.Feedback, PasswordTooLong)
+		return strength
+	}
+
+	normalized := normalizePassword(password)
+	lower := []rune(strings.ToLower(password))
+	marked := make([]bool, len(lower))
+
+	// A common password stays one with a few digits or symbols around it.
+	trimmed := strings.TrimFunc(string(lower), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	common := commonPasswords[normalized] || commonPasswords[normalizePassword(trimmed)]
+
+	// Each guessable part costs a few guesses instead of its length.
+	bits := 0.0
+	personal := markWords(normalized, personalTokens(userInputs), marked) > 0
+	if personal {
+		strength.Feedback = append(strength.Feedback, PasswordPersonal)
+		bits += 2
+	}
+	if n := markWords(normalized, commonPasswordWords, marked); n > 0 {
+		bits += float64(n) * math.Log2(float64(len(commonPasswords)))
+	}
+	if markRuns(lower, marked) {
+		strength.Feedback = append(strength.Feedback, PasswordSequence)
+		bits += 4
+	}
+	if markRepeats(lower, marked) {
+		strength.Feedback = append(strength.Feedback, PasswordRepetitive)
+		bits += 2
+	}
+
+	free := 0
+	for _, m := range marked {
+		if !m {
+			free++
+		}
+	}
+	bits += float64(free) * math.Log2(float64(passwordPoolSize(password)))
+
+	if common {
+		strength.Feedback = append(strength.Feedback, PasswordCommon)
+		bits = 0
+	}
+
+	switch {
+	case bits < 20:
+		strength.Score = 0
+	case bits < 30:
+		strength.Score = 1
+	case bits < minPasswordBits:
+		strength.Score = 2
+	case bits < 60:
+		strength.Score = 3
+	default:
+		strength.Score = 4
+	}
+
+	strength.Acceptable = !tooShort && !common && !personal && bits >= minPasswordBits
+	if !strength.Acceptable && len(strength.Feedback) == 0 {
+		strength.Feedback = append(strength.Feedback, PasswordWeak)
+	}
+
+	return strength
+}
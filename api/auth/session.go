@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// AccessTokenDuration is the lifetime of the JWTs, which are refreshed with
+// the refresh token of their session.
+const AccessTokenDuration = 15 * time.Minute
+
+// RefreshTokenDuration is how long a session lasts without being used.
+const RefreshTokenDuration = 30 * 24 * time.Hour
+
+// ImpersonationDuration is how long an admin can see the app as a member.
+const ImpersonationDuration = 15 * time.Minute
+
+var ErrSessionRevoked = errors.New("session revoked")
+
+// SessionValidator returns ErrSessionRevoked if the session was revoked or
+// has expired.
+type SessionValidator func(ctx context.Context, sessionID string) error
+
+// NewSecret returns a random token, to be stored hashed with HashToken.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func NewRefreshToken() (string, error) {
+	return NewSecret()
+}
+
+// HashToken hashes a random token before storing it, so that the tokens
+// cannot be used by someone reading the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
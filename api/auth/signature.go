@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+func signature(key []byte, resource string, expires int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("signed-url\x00" + resource + "\x00" + strconv.FormatInt(expires, 10)))
+	return mac.Sum(nil)
+}
+
+// Sign returns a signature granting access to resource until expires.
+func Sign(key []byte, resource string, expires time.Time) string {
+	return base64.RawURLEncoding.EncodeToString(signature(key, resource, expires.Unix()))
+}
+
+// CheckSignature tells whether sig was returned by Sign for resource and has
+// not expired.
+func CheckSignature(key []byte, resource string, expires int64, sig string) bool {
+	if time.Now().Unix() > expires {
+		return false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(decoded, signature(key, resource, expires))
+}
@@ -1,36 +1,72 @@
 package auth
 
 import (
+	"errors"
 	"time"
 
-	"github.com/brianvoe/gofakeit/v6"
 	"github.com/golang-jwt/jwt/v4"
 )
 
 type CustomClaims struct {
-	UserID string `json:"user_id"`
-	Admin  bool   `json:"admin"`
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	// Permissions are granted by the roles of the user.
+	Permissions []string `json:"permissions"`
+	// MFA is true when the session was opened with a second factor.
+	MFA bool `json:"mfa"`
+	// ImpersonatorID is the admin viewing the app as the user, if any.
+	ImpersonatorID string `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewToken(key []byte, userID string, admin bool) (string, error) {
+var ErrTokenInvalid = errors.New("token invalid")
+
+func NewToken(keys *KeySet, sessionID, userID string, permissions []string, mfa bool) (string, error) {
+	claims := CustomClaims{
+		SessionID:   sessionID,
+		UserID:      userID,
+		Permissions: permissions,
+		MFA:         mfa,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenDuration)),
+		},
+	}
+
+	return keys.Sign(claims)
+}
+
+// NewImpersonationToken lets an admin see the app as the user. It grants no
+// permission and cannot be refreshed.
+func NewImpersonationToken(keys *KeySet, sessionID, userID, impersonatorID string, expiresAt time.Time) (string, error) {
 	claims := CustomClaims{
-		userID,
-		admin,
-		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(14 * 24 * time.Hour)),
+		SessionID:      sessionID,
+		UserID:         userID,
+		ImpersonatorID: impersonatorID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return keys.Sign(claims)
+}
+
+func ParseToken(keys *KeySet, token string) (*CustomClaims, error) {
+	claims := new(CustomClaims)
+	if err := keys.Parse(token, claims); err != nil {
+		return nil, err
+	}
 
-	return token.SignedString(key)
+	return claims, nil
 }
 
 func NewConfirmToken() string {
-	return gofakeit.DigitN(6)
+	return newCode()
 }
 
 func NewResetToken() string {
-	return gofakeit.DigitN(6)
+	return newCode()
+}
+
+func NewEmailChangeToken() string {
+	return newCode()
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/price"
+	"github.com/uptrace/bun"
+)
+
+const sharePriceTTL = time.Hour
+
+// sharePriceCache keeps the price of one share, in euros, read from the
+// Stripe price of the checkouts so that the campaigns count what the members
+// actually pay. Stripe being down does not stop the API: the price is fetched
+// again when needed, and the last known one is kept meanwhile.
+type sharePriceCache struct {
+	mu        sync.Mutex
+	priceID   string
+	price     uint
+	fetchedAt time.Time
+}
+
+var sharePrice = &sharePriceCache{}
+
+func (cache *sharePriceCache) get() (uint, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.price != 0 && time.Since(cache.fetchedAt) < sharePriceTTL {
+		return cache.price, nil
+	}
+
+	p, err := fetchSharePrice(cache.priceID)
+	if err != nil {
+		if cache.price != 0 {
+			log.Printf("error refreshing the share price, keeping %d €: %v", cache.price, err)
+			return cache.price, nil
+		}
+
+		return 0, err
+	}
+
+	cache.price = p
+	cache.fetchedAt = time.Now()
+
+	return cache.price, nil
+}
+
+// fetchSharePrice reads the price of one share from a Stripe price.
+func fetchSharePrice(priceID string) (uint, error) {
+	p, err := price.Get(priceID, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.Currency != stripe.CurrencyEUR {
+		return 0, fmt.Errorf("price %s is in %s, not in euros", priceID, p.Currency)
+	}
+	if p.UnitAmount <= 0 || p.UnitAmount%100 != 0 {
+		return 0, fmt.Errorf("price %s is not a whole number of euros", priceID)
+	}
+
+	return uint(p.UnitAmount / 100), nil
+}
+
+const campaignProgressCacheTTL = time.Minute
+
+// capCheckoutDuration is how long a checkout stays open during a campaign
+// with a cap: 30 minutes is the shortest Stripe accepts.
+const capCheckoutDuration = 30 * time.Minute
+
+type Campaign struct {
+	bun.BaseModel `bun:"table:campaigns"`
+
+	ID        string    `bun:"id,pk,type:uuid,default:gen_random_uuid()" json:"id"`
+	Name      string    `bun:"name,notnull" json:"name"`
+	Goal      uint      `bun:"goal,notnull" json:"goal"`
+	Cap       *uint     `bun:"cap" json:"cap"`
+	StartsAt  time.Time `bun:"starts_at,notnull" json:"startsAt"`
+	EndsAt    time.Time `bun:"ends_at,notnull" json:"endsAt"`
+	CreatedAt time.Time `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+}
+
+type CampaignRequest struct {
+	Name     string    `json:"name" binding:"required"`
+	Goal     uint      `json:"goal" binding:"required"`
+	Cap      *uint     `json:"cap" binding:"omitempty,gtefield=Goal"`
+	StartsAt time.Time `json:"starts_at" binding:"required"`
+	EndsAt   time.Time `json:"ends_at" binding:"required,gtfield=StartsAt"`
+}
+
+type CampaignProgressResponse struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Goal     uint      `json:"goal"`
+	Cap      *uint     `json:"cap"`
+	Raised   uint      `json:"raised"`
+	Shares   uint      `json:"shares"`
+	Members  uint      `json:"members"`
+	Percent  uint      `json:"percent"`
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+	Closed   bool      `json:"closed"`
+}
+
+type campaignProgressCacheEntry struct {
+	progress  *CampaignProgressResponse
+	expiresAt time.Time
+}
+
+type campaignProgressCache struct {
+	mu      sync.Mutex
+	entries map[string]campaignProgressCacheEntry
+}
+
+func (cache *campaignProgressCache) get(key string) (*CampaignProgressResponse, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	entry, ok := cache.entries[key]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false
+	}
+
+	return entry.progress, true
+}
+
+func (cache *campaignProgressCache) set(key string, progress *CampaignProgressResponse) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.entries[key] = campaignProgressCacheEntry{progress, time.Now().Add(campaignProgressCacheTTL)}
+}
+
+func (cache *campaignProgressCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.entries = make(map[string]campaignProgressCacheEntry)
+}
+
+// activeCampaign returns the campaign running at the current time, or nil if
+// there is none.
+func activeCampaign(ctx context.Context, db bun.IDB) (*Campaign, error) {
+	campaign := new(Campaign)
+	err := db.NewSelect().Model(campaign).Where("starts_at <= now()").Where("ends_at > now()").Order("starts_at DESC").Limit(1).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return campaign, nil
+}
+
+// campaignRaised returns the amount raised by a campaign, in euros.
+func campaignRaised(ctx context.Context, db bun.IDB, campaignID string) (uint, error) {
+	var shares uint
+	err := db.NewSelect().Table("payments").ColumnExpr("COALESCE(SUM(shares), 0)").Where("campaign_id = ?", campaignID).Scan(ctx, &shares)
+	if err != nil {
+		return 0, err
+	}
+
+	euros, err := sharePrice.get()
+	if err != nil {
+		return 0, err
+	}
+
+	return shares * euros, nil
+}
+
+func campaignOverlaps(ctx context.Context, db bun.IDB, startsAt, endsAt time.Time, exceptID string) (bool, error) {
+	query := db.NewSelect().Table("campaigns").Where("starts_at < ?", endsAt).Where("ends_at > ?", startsAt)
+	if exceptID != "" {
+		query = query.Where("id != ?", exceptID)
+	}
+
+	return query.Exists(ctx)
+}
+
+func getCampaignProgress(ctx context.Context, db bun.IDB, campaign *Campaign) (*CampaignProgressResponse, error) {
+	var totals struct {
+		Shares  uint
+		Members uint
+	}
+	err := db.NewSelect().Table("payments").ColumnExpr("COALESCE(SUM(shares), 0) AS shares").ColumnExpr("COUNT(DISTINCT user_id) AS members").Where("campaign_id = ?", campaign.ID).Scan(ctx, &totals)
+	if err != nil {
+		return nil, err
+	}
+
+	euros, err := sharePrice.get()
+	if err != nil {
+		return nil, err
+	}
+
+	raised := totals.Shares * euros
+
+	var percent uint
+	if campaign.Goal > 0 {
+		percent = raised * 100 / campaign.Goal
+	}
+
+	now := time.Now()
+	closed := now.Before(campaign.StartsAt) || !now.Before(campaign.EndsAt) || (campaign.Cap != nil && raised >= *campaign.Cap)
+
+	return &CampaignProgressResponse{
+		ID:       campaign.ID,
+		Name:     campaign.Name,
+		Goal:     campaign.Goal,
+		Cap:      campaign.Cap,
+		Raised:   raised,
+		Shares:   totals.Shares,
+		Members:  totals.Members,
+		Percent:  percent,
+		StartsAt: campaign.StartsAt,
+		EndsAt:   campaign.EndsAt,
+		Closed:   closed,
+	}, nil
+}
+
+func registerCampaignRoutes(r *gin.Engine, admin *gin.RouterGroup, db *bun.DB) {
+	cache := &campaignProgressCache{entries: make(map[string]campaignProgressCacheEntry)}
+
+	// The progress of a campaign is public: it is displayed by a widget on our
+	// website, hence the caching.
+	r.GET("/campaigns/:campaignID/progress", func(c *gin.Context) {
+		campaignID := c.Param("campaignID")
+
+		if progress, ok := cache.get(campaignID); ok {
+			c.Header("Cache-Control", "public, max-age=60")
+			c.JSON(http.StatusOK, progress)
+			return
+		}
+
+		var campaign *Campaign
+		if campaignID == "current" {
+			var err error
+			campaign, err = activeCampaign(c, db)
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+			if campaign == nil {
+				c.JSON(http.StatusNotFound, ErrorResponse{"No campaign is running.", "not-found"})
+				return
+			}
+		} else {
+			if _, err := uuid.Parse(campaignID); err != nil {
+				c.JSON(http.StatusNotFound, ErrorResponse{"Campaign not found.", "not-found"})
+				return
+			}
+
+			campaign = new(Campaign)
+			if err := db.NewSelect().Model(campaign).Where("id = ?", campaignID).Scan(c); err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					c.JSON(http.StatusNotFound, ErrorResponse{"Campaign not found.", "not-found"})
+					return
+				}
+
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
+		progress, err := getCampaignProgress(c, db, campaign)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		cache.set(campaignID, progress)
+
+		c.Header("Cache-Control", "public, max-age=60")
+		c.JSON(http.StatusOK, progress)
+	})
+
+	admin.GET("/campaigns", func(c *gin.Context) {
+		campaigns := make([]*Campaign, 0)
+		if err := db.NewSelect().Model(&campaigns).Order("starts_at DESC").Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*CampaignProgressResponse, 0, len(campaigns))
+		for _, campaign := range campaigns {
+			progress, err := getCampaignProgress(c, db, campaign)
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+
+			response = append(response, progress)
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admin.POST("/campaigns", func(c *gin.Context) {
+		var json CampaignRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		overlaps, err := campaignOverlaps(c, db, json.StartsAt, json.EndsAt, "")
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if overlaps {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Another campaign is running during these dates.", "campaign-overlap"})
+			return
+		}
+
+		campaign := &Campaign{
+			Name:     json.Name,
+			Goal:     json.Goal,
+			Cap:      json.Cap,
+			StartsAt: json.StartsAt,
+			EndsAt:   json.EndsAt,
+		}
+
+		if _, err := db.NewInsert().Model(campaign).Returning("*").Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		cache.clear()
+
+		if err := writeAudit(c, db, c.GetString("userID"), c.ClientIP(), "campaign.create", "campaign", campaign.ID, map[string]interface{}{
+			"name": campaign.Name,
+		}); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, campaign)
+	})
+
+	admin.PUT("/campaigns/:campaignID", func(c *gin.Context) {
+		campaignID := c.Param("campaignID")
+		if _, err := uuid.Parse(campaignID); err != nil {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Campaign not found.", "not-found"})
+			return
+		}
+
+		var json CampaignRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		overlaps, err := campaignOverlaps(c, db, json.StartsAt, json.EndsAt, campaignID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if overlaps {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Another campaign is running during these dates.", "campaign-overlap"})
+			return
+		}
+
+		campaign := &Campaign{
+			ID:       campaignID,
+			Name:     json.Name,
+			Goal:     json.Goal,
+			Cap:      json.Cap,
+			StartsAt: json.StartsAt,
+			EndsAt:   json.EndsAt,
+		}
+
+		result, err := db.NewUpdate().Model(campaign).Column("name", "goal", "cap", "starts_at", "ends_at").WherePK().Returning("*").Exec(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Campaign not found.", "not-found"})
+			return
+		}
+
+		cache.clear()
+
+		if err := writeAudit(c, db, c.GetString("userID"), c.ClientIP(), "campaign.update", "campaign", campaign.ID, map[string]interface{}{
+			"name": campaign.Name,
+		}); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, campaign)
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/customer"
+	"github.com/uptrace/bun"
+)
+
+type StartEmailChangeRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+var errEmailUsed = errors.New("email used")
+
+func emailUsed(ctx context.Context, db bun.IDB, email string) (bool, error) {
+	return db.NewSelect().Table("users").Where("email = ?", email).Exists(ctx)
+}
+
+// The email address is the login of the member and the email of their Stripe
+// customer: it only changes once the new address is proven, and the old one is
+// told about it.
+func registerEmailChangeRoutes(authorized *gin.RouterGroup, db *bun.DB, mg mailgun.Mailgun, key []byte) {
+	authorized.POST("/users/me/email", func(c *gin.Context) {
+		var json StartEmailChangeRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+		json.Email = strings.TrimSpace(json.Email)
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.GetString("userID")).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		accountKey := accountThrottleKey("email", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		if json.Email == user.Email {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This is already your email address.", "email-unchanged"})
+			return
+		}
+
+		used, err := emailUsed(c, db, json.Email)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if used {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"An user using this email address already exists.", "email-used"})
+			return
+		}
+
+		token := auth.NewEmailChangeToken()
+		tokenHash := auth.HashCode(key, token)
+		tokenExpiresAt := time.Now().Add(auth.EmailChangeTokenDuration)
+
+		update := &User{ID: user.ID, NewEmail: &json.Email, EmailChangeToken: &tokenHash, EmailChangeTokenExpiresAt: &tokenExpiresAt}
+		if _, err := db.NewUpdate().Model(update).Column("new_email", "email_change_token", "email_change_token_expires_at").WherePK().Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := sendChangeEmailEmail(mg, json.Email, token); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// Should the password have leaked, the member learns about it before
+		// losing their account.
+		if err := sendEmailChangeNoticeEmail(mg, user.Email, json.Email); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	authorized.POST("/users/me/email/confirm", func(c *gin.Context) {
+		var json ConfirmEmailChangeRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.GetString("userID")).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		ipKey := ipThrottleKey(c)
+		accountKey := accountThrottleKey("email", user.ID)
+		if !checkThrottle(c, db, accountKey, ipKey) {
+			return
+		}
+
+		if user.NewEmail == nil || user.EmailChangeToken == nil || !auth.CheckCode(key, json.Token, *user.EmailChangeToken) {
+			failFlowCode(c, db, user, "email_change_token", accountKey, ipKey)
+			return
+		}
+
+		if user.EmailChangeTokenExpiresAt != nil && user.EmailChangeTokenExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This token has expired.", "token-expired"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		previousEmail := user.Email
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			// The address may have been taken since the code was sent.
+			used, err := emailUsed(ctx, tx, *user.NewEmail)
+			if err != nil {
+				return err
+			}
+			if used {
+				return errEmailUsed
+			}
+
+			update := &User{ID: user.ID, Email: *user.NewEmail}
+			if _, err := tx.NewUpdate().Model(update).Column("email", "new_email", "email_change_token", "email_change_token_expires_at").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			after := *user
+			after.Email = update.Email
+			if _, err := recordProfileChanges(ctx, tx, user, &after, user.ID); err != nil {
+				return err
+			}
+
+			if err := writeAudit(ctx, tx, user.ID, c.ClientIP(), "email.change", "user", user.ID, map[string]interface{}{
+				"before": previousEmail,
+				"after":  update.Email,
+			}); err != nil {
+				return err
+			}
+
+			return nil
+		})
+		if errors.Is(err, errEmailUsed) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"An user using this email address already exists.", "email-used"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// The receipts are sent by Stripe to the address of the customer. The
+		// client of stripe-go already retries on network errors: what still
+		// fails is logged, the address being changed in the app anyway.
+		if _, err := customer.Update(user.Customer, &stripe.CustomerParams{Email: stripe.String(*user.NewEmail)}); err != nil {
+			log.Printf("error updating the email address of Stripe customer %s: %v", user.Customer, err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"email": *user.NewEmail})
+	})
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/customer"
+	"github.com/uptrace/bun"
+)
+
+// erasedEmailDomain is reserved, so that the address of an erased member
+// never reaches anyone.
+const erasedEmailDomain = "erased.invalid"
+
+var (
+	errUserErased   = errors.New("user erased")
+	errUserHasRoles = errors.New("user has roles")
+)
+
+type RequestErasureRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// ErasurePreviewItem is a kind of data of the member, with how many of them
+// there are and, when kept, why.
+type ErasurePreviewItem struct {
+	Data   string `json:"data"`
+	Count  int    `json:"count"`
+	Reason string `json:"reason,omitempty"`
+	// Kept lists what is kept of the data, when only part of it is.
+	Kept []string `json:"kept,omitempty"`
+}
+
+type ErasurePreviewResponse struct {
+	ErasureRequestedAt *time.Time            `json:"erasureRequestedAt"`
+	Removed            []*ErasurePreviewItem `json:"removed"`
+	Retained           []*ErasurePreviewItem `json:"retained"`
+}
+
+// newPseudonym identifies an erased member in the register of the partners
+// and the accounting records.
+func newPseudonym() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "ANONYME-" + base32.StdEncoding.EncodeToString(b), nil
+}
+
+func countRows(ctx context.Context, db bun.IDB, table, where string, args ...interface{}) (int, error) {
+	return db.NewSelect().Table(table).Where(where, args...).Count(ctx)
+}
+
+func previewErasure(ctx context.Context, db bun.IDB, user *User) (*ErasurePreviewResponse, error) {
+	preview := &ErasurePreviewResponse{ErasureRequestedAt: user.ErasureRequestedAt}
+
+	documents := 0
+	for _, document := range []*string{user.IdentityFront, user.IdentityBack, user.AddressProof} {
+		if document != nil {
+			documents++
+		}
+	}
+
+	preview.Removed = []*ErasurePreviewItem{
+		{Data: "contact-data", Count: 1},
+		{Data: "documents", Count: documents},
+	}
+	if user.Customer != "" {
+		preview.Removed = append(preview.Removed, &ErasurePreviewItem{Data: "stripe-customer", Count: 1})
+	}
+
+	removed := []struct {
+		data  string
+		table string
+		where string
+	}{
+		{"sessions", "sessions", "user_id = ?"},
+		{"passkeys", "passkeys", "user_id = ?"},
+		{"login-links", "login_links", "user_id = ?"},
+		{"oidc-codes", "oidc_codes", "user_id = ?"},
+		{"oidc-consents", "oidc_consents", "user_id = ?"},
+		{"profile-changes", "profile_changes", "user_id = ?"},
+		{"data-exports", "data_exports", "user_id = ?"},
+		{"gift-recipients", "gifts", "buyer_user_id = ? AND (recipient_name IS NOT NULL OR recipient_email IS NOT NULL OR message IS NOT NULL)"},
+	}
+	for _, item := range removed {
+		count, err := countRows(ctx, db, item.table, item.where, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		preview.Removed = append(preview.Removed, &ErasurePreviewItem{Data: item.data, Count: count})
+	}
+
+	preview.Retained = []*ErasurePreviewItem{
+		{Data: "membership", Count: 1, Reason: "register-of-partners"},
+	}
+
+	retained := []struct {
+		data   string
+		table  string
+		where  string
+		reason string
+		kept   []string
+	}{
+		{"payments", "payments", "user_id = ?", "accounting", nil},
+		{"share-movements", "share_movements", "user_id = ?", "register-of-partners", nil},
+		{"gifts", "gifts", "buyer_user_id = ? OR claimed_by_user_id = ?", "accounting", nil},
+		// The addresses, IP and email, are removed from the entries, but the
+		// changes of roles and the impersonations are kept.
+		{"audit-log", "audit_log", "(target_type = 'user' AND target_id = ?) OR actor_user_id = ?", "security", []string{"actions", "dates", "roles", "impersonations"}},
+	}
+	for _, item := range retained {
+		args := []interface{}{user.ID}
+		if strings.Count(item.where, "?") == 2 {
+			args = append(args, user.ID)
+		}
+
+		count, err := countRows(ctx, db, item.table, item.where, args...)
+		if err != nil {
+			return nil, err
+		}
+		preview.Retained = append(preview.Retained, &ErasurePreviewItem{Data: item.data, Count: count, Reason: item.reason, Kept: item.kept})
+	}
+
+	return preview, nil
+}
+
+// eraseUser anonymizes the member, keeping their shares, category and
+// payments under a pseudonym. The files are removed and the Stripe customer
+// detached by the caller, once the transaction is committed.
+func eraseUser(ctx context.Context, tx bun.Tx, user *User, actorUserID, ip string) (string, error) {
+	if user.ErasedAt != nil {
+		return "", errUserErased
+	}
+	if len(user.Roles) > 0 {
+		return "", errUserHasRoles
+	}
+
+	pseudonym, err := newPseudonym()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	update := &User{
+		ID:          user.ID,
+		Roles:       []string{},
+		Email:       pseudonym + "@" + erasedEmailDomain,
+		Password:    "",
+		PhoneNumber: "",
+		FirstName:   "",
+		LastName:    pseudonym,
+		Address:     "",
+		PostalCode:  "",
+		City:        "",
+		Country:     "",
+		Customer:    "",
+		ErasedAt:    &now,
+	}
+	// The password is emptied, which no password matches, and the other
+	// columns are set to NULL.
+	_, err = tx.NewUpdate().Model(update).
+		Column("roles", "email", "password", "phone_number", "first_name", "last_name", "address", "postal_code", "city", "country", "customer", "reason", "erased_at").
+		Column("confirm_token", "confirm_token_expires_at", "reset_token", "reset_token_expires_at").
+		Column("new_email", "email_change_token", "email_change_token_expires_at").
+		Column("totp_secret", "totp_enabled_at", "totp_last_step").
+		Column("identity_front", "identity_back", "address_proof", "pending_gift_code").
+		WherePK().Exec(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, table := range []string{"sessions", "recovery_codes", "passkeys", "passkey_challenges", "login_links", "oidc_codes", "oidc_consents", "profile_changes", "data_exports"} {
+		if _, err := tx.NewDelete().Table(table).Where("user_id = ?", user.ID).Exec(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	// The recipients of the gifts are not members: their data goes too.
+	if _, err := tx.NewUpdate().Table("gifts").Set("recipient_name = NULL, recipient_email = NULL, message = NULL, delivery_error = NULL").Where("buyer_user_id = ?", user.ID).Exec(ctx); err != nil {
+		return "", err
+	}
+
+	// The audit log is kept, but not the addresses in it: the email
+	// addresses of the member and of the recipients of their gifts, and the
+	// IP addresses the member acted from.
+	if err := allowAuditMaintenance(ctx, tx); err != nil {
+		return "", err
+	}
+	if _, err := tx.NewUpdate().Table("audit_log").Set("details = '{}'").Where("target_type = 'user'").Where("target_id = ?", user.ID).Where("action = 'email.change'").Exec(ctx); err != nil {
+		return "", err
+	}
+	if _, err := tx.NewUpdate().Table("audit_log").Set("details = '{}'").Where("target_type = 'gift'").Where("target_id IN (SELECT id::text FROM gifts WHERE buyer_user_id = ?)", user.ID).Where("action = 'gift.resend'").Exec(ctx); err != nil {
+		return "", err
+	}
+	if _, err := tx.NewUpdate().Table("audit_log").Set("ip = NULL").Where("actor_user_id = ?", user.ID).Exec(ctx); err != nil {
+		return "", err
+	}
+
+	if err := writeAudit(ctx, tx, actorUserID, ip, "user.erase", "user", user.ID, map[string]interface{}{
+		"pseudonym": pseudonym,
+	}); err != nil {
+		return "", err
+	}
+
+	return pseudonym, nil
+}
+
+// detachStripeCustomer removes the contact data of an erased member from
+// their Stripe customer. The customer itself is kept, with the payments
+// Stripe keeps for its own obligations. Updating it again is harmless, and a
+// customer removed by hand in Stripe has nothing left to detach.
+func detachStripeCustomer(customerID, pseudonym string) error {
+	_, err := customer.Update(customerID, &stripe.CustomerParams{
+		Name:  stripe.String(pseudonym),
+		Email: stripe.String(""),
+	})
+
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.Code == stripe.ErrorCodeResourceMissing {
+		return nil
+	}
+
+	return err
+}
+
+// removeUserFiles deletes the uploaded documents and the data exports of an
+// erased member.
+func removeUserFiles(dataPath string, userID string, exportIDs []string) {
+	if err := os.RemoveAll(filepath.Join(dataPath, "uploads", userID)); err != nil {
+		log.Printf("error removing the documents of %s: %v", userID, err)
+	}
+
+	for _, exportID := range exportIDs {
+		if err := os.Remove(dataExportPath(dataPath, exportID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing data export %s: %v", exportID, err)
+		}
+	}
+}
+
+func registerErasureRoutes(authorized *gin.RouterGroup, editors *gin.RouterGroup, db *bun.DB, dataPath string) {
+	// The member asks for the erasure, which an admin then reviews: the
+	// shares of the member may first have to be paid back.
+	authorized.POST("/users/me/erasure", func(c *gin.Context) {
+		var json RequestErasureRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.GetString("userID")).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		accountKey := accountThrottleKey("erasure", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		if user.ErasureRequestedAt != nil {
+			c.JSON(http.StatusOK, gin.H{"erasureRequestedAt": user.ErasureRequestedAt})
+			return
+		}
+
+		now := time.Now()
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			update := &User{ID: user.ID, ErasureRequestedAt: &now}
+			if _, err := tx.NewUpdate().Model(update).Column("erasure_requested_at").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, user.ID, c.ClientIP(), "user.erasure.request", "user", user.ID, nil)
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"erasureRequestedAt": now})
+	})
+
+	editors.GET("/users/:userID/erasure", func(c *gin.Context) {
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.Param("userID")).Scan(c); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this ID.", "id-unknown"})
+				return
+			}
+
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if user.ErasedAt != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This user has already been erased.", "user-erased"})
+			return
+		}
+
+		preview, err := previewErasure(c, db, user)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, preview)
+	})
+
+	editors.POST("/users/:userID/erasure", func(c *gin.Context) {
+		user := new(User)
+		var pseudonym string
+		var exportIDs []string
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := tx.NewSelect().Model(user).Where("id = ?", c.Param("userID")).For("UPDATE").Scan(ctx); err != nil {
+				return err
+			}
+
+			if err := tx.NewSelect().Table("data_exports").Column("id").Where("user_id = ?", user.ID).Scan(ctx, &exportIDs); err != nil {
+				return err
+			}
+
+			var err error
+			pseudonym, err = eraseUser(ctx, tx, user, c.GetString("userID"), c.ClientIP())
+			return err
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this ID.", "id-unknown"})
+			return
+		}
+		if errors.Is(err, errUserErased) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This user has already been erased.", "user-erased"})
+			return
+		}
+		if errors.Is(err, errUserHasRoles) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"The roles of this user must be removed first.", "user-has-roles"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// Stripe is only updated once the erasure is committed. A failure is
+		// logged with the customer, so that it can be detached by hand.
+		if user.Customer != "" {
+			if err := detachStripeCustomer(user.Customer, pseudonym); err != nil {
+				log.Printf("error detaching Stripe customer %s of erased user %s: %v", user.Customer, user.ID, err)
+			}
+		}
+
+		removeUserFiles(dataPath, user.ID, exportIDs)
+
+		c.JSON(http.StatusOK, gin.H{"pseudonym": pseudonym})
+	})
+}
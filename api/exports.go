@@ -0,0 +1,640 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/uptrace/bun"
+)
+
+const (
+	DataExportStatusPending = "pending"
+	DataExportStatusReady   = "ready"
+	DataExportStatusFailed  = "failed"
+	DataExportStatusExpired = "expired"
+)
+
+const (
+	// dataExportReuseDuration is how long an export is given again instead of
+	// building a new one, as exports are costly.
+	dataExportReuseDuration = 24 * time.Hour
+	dataExportDuration      = 7 * 24 * time.Hour
+	dataExportJobsInterval  = time.Minute
+)
+
+// DataExport is a copy of the data of a member, which they are entitled to
+// under the GDPR. It is built in the background and kept for a week.
+type DataExport struct {
+	bun.BaseModel `bun:"table:data_exports"`
+
+	ID          string     `bun:"id,pk,type:uuid,default:gen_random_uuid()" json:"id"`
+	UserID      string     `bun:"user_id,notnull" json:"-"`
+	Status      string     `bun:"status,notnull,default:'pending'" json:"status"`
+	CreatedAt   time.Time  `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+	CompletedAt *time.Time `bun:"completed_at" json:"completedAt"`
+	ExpiresAt   *time.Time `bun:"expires_at" json:"expiresAt"`
+}
+
+// The sections of the export. Secrets, such as the password hash or the gift
+// codes, are left out.
+type exportProfile struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	PhoneNumber string     `json:"phoneNumber"`
+	FirstName   string     `json:"firstName"`
+	LastName    string     `json:"lastName"`
+	Address     string     `json:"address"`
+	PostalCode  string     `json:"postalCode"`
+	City        string     `json:"city"`
+	Country     string     `json:"country"`
+	Roles       []string   `json:"roles"`
+	CreatedAt   *time.Time `json:"createdAt"`
+}
+
+type exportMembership struct {
+	Category      string  `json:"category"`
+	Reason        *string `json:"reason"`
+	Accepted      bool    `json:"accepted"`
+	InitialShares uint    `json:"initialShares"`
+	Shares        uint    `json:"shares"`
+}
+
+type exportPayment struct {
+	ID        string    `json:"id"`
+	Shares    uint      `json:"shares"`
+	GiftID    *string   `json:"giftId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportGift struct {
+	ID             string     `json:"id"`
+	Status         string     `json:"status"`
+	Shares         uint       `json:"shares"`
+	RecipientName  *string    `json:"recipientName,omitempty"`
+	RecipientEmail *string    `json:"recipientEmail,omitempty"`
+	Message        *string    `json:"message,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	PaidAt         *time.Time `json:"paidAt,omitempty"`
+	ClaimedAt      *time.Time `json:"claimedAt,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+type exportShareMovement struct {
+	Kind      string    `json:"kind"`
+	Shares    int       `json:"shares"`
+	GiftID    *string   `json:"giftId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type exportActivity struct {
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// exportConsent is the consent of the member to share their data with an
+// application logging in with Entrelac.coop.
+type exportConsent struct {
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scope      string    `json:"scope"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type exportFile struct {
+	Path        string `json:"path"`
+	Description string `json:"description"`
+}
+
+// exportManifest is the manifest.json of the export, holding all the data in
+// a structured form along with the list of the files.
+type exportManifest struct {
+	GeneratedAt    time.Time              `json:"generatedAt"`
+	Profile        *exportProfile         `json:"profile"`
+	Membership     *exportMembership      `json:"membership"`
+	Payments       []*exportPayment       `json:"payments"`
+	GiftsBought    []*exportGift          `json:"giftsBought"`
+	GiftsClaimed   []*exportGift          `json:"giftsClaimed"`
+	ShareMovements []*exportShareMovement `json:"shareMovements"`
+	ProfileChanges []*ProfileChange       `json:"profileChanges"`
+	Activity       []*exportActivity      `json:"activity"`
+	Consents       []*exportConsent       `json:"consents"`
+	// NotHeld lists the data the member may expect, but which is not kept.
+	NotHeld []string      `json:"notHeld"`
+	Files   []*exportFile `json:"files"`
+}
+
+func newExportGift(gift *Gift, withRecipient bool) *exportGift {
+	item := &exportGift{
+		ID:          gift.ID,
+		Status:      gift.Status,
+		Shares:      gift.Shares,
+		CreatedAt:   gift.CreatedAt,
+		PaidAt:      gift.PaidAt,
+		ClaimedAt:   gift.ClaimedAt,
+		DeliveredAt: gift.DeliveredAt,
+	}
+	if withRecipient {
+		item.RecipientName = gift.RecipientName
+		item.RecipientEmail = gift.RecipientEmail
+		item.Message = gift.Message
+	}
+
+	return item
+}
+
+func collectExportManifest(ctx context.Context, db *bun.DB, user *User) (*exportManifest, error) {
+	manifest := &exportManifest{
+		GeneratedAt: time.Now(),
+		NotHeld: []string{
+			"assembly-participation",
+		},
+	}
+
+	var createdAt *time.Time
+	if err := db.NewSelect().Table("users").Column("created_at").Where("id = ?", user.ID).Scan(ctx, &createdAt); err != nil {
+		return nil, err
+	}
+
+	manifest.Profile = &exportProfile{
+		ID:          user.ID,
+		Email:       user.Email,
+		PhoneNumber: user.PhoneNumber,
+		FirstName:   user.FirstName,
+		LastName:    user.LastName,
+		Address:     user.Address,
+		PostalCode:  user.PostalCode,
+		City:        user.City,
+		Country:     user.Country,
+		Roles:       user.Roles,
+		CreatedAt:   createdAt,
+	}
+
+	shares, err := userShares(ctx, db, user)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest.Membership = &exportMembership{
+		Category:      user.Category,
+		Reason:        user.Reason,
+		Accepted:      user.Accepted,
+		InitialShares: user.InitialShares,
+		Shares:        shares,
+	}
+
+	payments := make([]*Payment, 0)
+	if err := db.NewSelect().Model(&payments).Where("user_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.Payments = make([]*exportPayment, 0, len(payments))
+	for _, payment := range payments {
+		manifest.Payments = append(manifest.Payments, &exportPayment{payment.ID, payment.Shares, payment.GiftID, payment.CreatedAt})
+	}
+
+	giftsBought := make([]*Gift, 0)
+	if err := db.NewSelect().Model(&giftsBought).Where("buyer_user_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.GiftsBought = make([]*exportGift, 0, len(giftsBought))
+	for _, gift := range giftsBought {
+		manifest.GiftsBought = append(manifest.GiftsBought, newExportGift(gift, true))
+	}
+
+	// The recipient fields of a claimed gift were written by its buyer.
+	giftsClaimed := make([]*Gift, 0)
+	if err := db.NewSelect().Model(&giftsClaimed).Where("claimed_by_user_id = ?", user.ID).Order("claimed_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.GiftsClaimed = make([]*exportGift, 0, len(giftsClaimed))
+	for _, gift := range giftsClaimed {
+		manifest.GiftsClaimed = append(manifest.GiftsClaimed, newExportGift(gift, false))
+	}
+
+	movements := make([]*ShareMovement, 0)
+	if err := db.NewSelect().Model(&movements).Where("user_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.ShareMovements = make([]*exportShareMovement, 0, len(movements))
+	for _, movement := range movements {
+		manifest.ShareMovements = append(manifest.ShareMovements, &exportShareMovement{movement.Kind, movement.Shares, movement.GiftID, movement.CreatedAt})
+	}
+
+	manifest.ProfileChanges = make([]*ProfileChange, 0)
+	if err := db.NewSelect().Model(&manifest.ProfileChanges).Where("user_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*AuditEntry, 0)
+	if err := db.NewSelect().Model(&entries).Where("target_type = ?", "user").Where("target_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.Activity = make([]*exportActivity, 0, len(entries))
+	for _, entry := range entries {
+		manifest.Activity = append(manifest.Activity, &exportActivity{entry.Action, entry.CreatedAt})
+	}
+
+	consents := make([]*OIDCConsent, 0)
+	if err := db.NewSelect().Model(&consents).Where("user_id = ?", user.ID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+	manifest.Consents = make([]*exportConsent, 0, len(consents))
+	for _, consent := range consents {
+		manifest.Consents = append(manifest.Consents, &exportConsent{consent.ClientID, consent.ClientName, consent.Scope, consent.CreatedAt})
+	}
+
+	return manifest, nil
+}
+
+// writeExportDocuments copies the uploaded documents into the archive. They
+// are stored without extension, which is guessed from their content.
+func writeExportDocuments(archive *zip.Writer, dataPath string, user *User, manifest *exportManifest) error {
+	documents := []struct {
+		name        string
+		key         *string
+		description string
+	}{
+		{"identity-front", user.IdentityFront, "Pièce d'identité (recto)"},
+		{"identity-back", user.IdentityBack, "Pièce d'identité (verso)"},
+		{"address-proof", user.AddressProof, "Justificatif de domicile"},
+	}
+
+	for _, document := range documents {
+		if document.key == nil {
+			continue
+		}
+
+		content, err := os.ReadFile(filepath.Join(dataPath, "uploads", user.ID, *document.key))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		name := "documents/" + document.name
+		contentType := strings.Split(http.DetectContentType(content), ";")[0]
+		if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+			name += extensions[0]
+		}
+
+		file, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(content); err != nil {
+			return err
+		}
+
+		manifest.Files = append(manifest.Files, &exportFile{name, document.description})
+	}
+
+	return nil
+}
+
+func formatExportTime(t time.Time) string {
+	return t.In(giftDeliveryLocation).Format("02/01/2006 15:04")
+}
+
+// writeExportSummary writes the summary.txt of the export, reading the
+// manifest for the members who would not open a JSON file.
+func writeExportSummary(w io.Writer, manifest *exportManifest) error {
+	var b strings.Builder
+
+	profile, membership := manifest.Profile, manifest.Membership
+
+	fmt.Fprintf(&b, "Vos données chez Entrelac.coop\n")
+	fmt.Fprintf(&b, "Export généré le %s.\n\n", formatExportTime(manifest.GeneratedAt))
+
+	fmt.Fprintf(&b, "== Profil ==\n")
+	fmt.Fprintf(&b, "Nom : %s %s\n", profile.FirstName, profile.LastName)
+	fmt.Fprintf(&b, "Adresse email : %s\n", profile.Email)
+	fmt.Fprintf(&b, "Téléphone : %s\n", profile.PhoneNumber)
+	fmt.Fprintf(&b, "Adresse : %s, %s %s, %s\n", profile.Address, profile.PostalCode, profile.City, profile.Country)
+	if profile.CreatedAt != nil {
+		fmt.Fprintf(&b, "Inscription : %s\n", formatExportTime(*profile.CreatedAt))
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Sociétariat ==\n")
+	fmt.Fprintf(&b, "Catégorie : %s\n", membership.Category)
+	if membership.Reason != nil {
+		fmt.Fprintf(&b, "Motivation : %s\n", *membership.Reason)
+	}
+	if membership.Accepted {
+		fmt.Fprintf(&b, "Demande validée : oui\n")
+	} else {
+		fmt.Fprintf(&b, "Demande validée : non\n")
+	}
+	fmt.Fprintf(&b, "Parts sociales : %d\n\n", membership.Shares)
+
+	fmt.Fprintf(&b, "== Paiements (%d) ==\n", len(manifest.Payments))
+	for _, payment := range manifest.Payments {
+		fmt.Fprintf(&b, "- %s : %d part(s)\n", formatExportTime(payment.CreatedAt), payment.Shares)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Cadeaux offerts (%d) ==\n", len(manifest.GiftsBought))
+	for _, gift := range manifest.GiftsBought {
+		fmt.Fprintf(&b, "- %s : %d part(s), %s", formatExportTime(gift.CreatedAt), gift.Shares, gift.Status)
+		if gift.RecipientName != nil {
+			fmt.Fprintf(&b, ", pour %s", *gift.RecipientName)
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Cadeaux reçus (%d) ==\n", len(manifest.GiftsClaimed))
+	for _, gift := range manifest.GiftsClaimed {
+		fmt.Fprintf(&b, "- %d part(s)", gift.Shares)
+		if gift.ClaimedAt != nil {
+			fmt.Fprintf(&b, ", reçues le %s", formatExportTime(*gift.ClaimedAt))
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Modifications du profil (%d) ==\n", len(manifest.ProfileChanges))
+	for _, change := range manifest.ProfileChanges {
+		fmt.Fprintf(&b, "- %s : %s, « %s » devient « %s »\n", formatExportTime(change.CreatedAt), change.Field, change.PreviousValue, change.NewValue)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Activité du compte (%d) ==\n", len(manifest.Activity))
+	for _, activity := range manifest.Activity {
+		fmt.Fprintf(&b, "- %s : %s\n", formatExportTime(activity.CreatedAt), activity.Action)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Consentements (%d) ==\n", len(manifest.Consents))
+	for _, consent := range manifest.Consents {
+		name := consent.ClientName
+		if name == "" {
+			name = consent.ClientID
+		}
+		fmt.Fprintf(&b, "- %s : partage de vos données avec %s (%s)\n", formatExportTime(consent.CreatedAt), name, consent.Scope)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "== Documents ==\n")
+	for _, file := range manifest.Files {
+		fmt.Fprintf(&b, "- %s : %s\n", file.Description, file.Path)
+	}
+	fmt.Fprintf(&b, "\n")
+
+	fmt.Fprintf(&b, "Entrelac.coop ne conserve pas d'historique de participation aux assemblées.\n")
+	fmt.Fprintf(&b, "Toutes ces données sont aussi dans manifest.json, dans un format lisible par une machine.\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dataExportPath(dataPath, exportID string) string {
+	return filepath.Join(dataPath, "exports", exportID+".zip")
+}
+
+// buildDataExport writes the archive of the export next to its final path,
+// then moves it there, so that a failure never leaves half an archive.
+func buildDataExport(ctx context.Context, db *bun.DB, dataPath string, export *DataExport) (*User, error) {
+	user := new(User)
+	if err := db.NewSelect().Model(user).Where("id = ?", export.UserID).Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	manifest, err := collectExportManifest(ctx, db, user)
+	if err != nil {
+		return nil, err
+	}
+
+	path := dataExportPath(dataPath, export.ID)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path + ".tmp")
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+
+	if err := writeExportDocuments(archive, dataPath, user, manifest); err != nil {
+		return nil, err
+	}
+
+	manifest.Files = append(manifest.Files, &exportFile{"summary.txt", "Résumé lisible de vos données"})
+
+	summary, err := archive.Create("summary.txt")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeExportSummary(summary, manifest); err != nil {
+		return nil, err
+	}
+
+	manifestFile, err := archive.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(manifestFile)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+
+	return user, os.Rename(path+".tmp", path)
+}
+
+func sendDataExportReadyEmail(mg mailgun.Mailgun, recipient, url string) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Vos données Entrelac.coop sont prêtes"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("data-export-ready")
+	err := message.AddTemplateVariable("url", url)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func processDataExports(ctx context.Context, db *bun.DB, mg mailgun.Mailgun, dataPath, appBaseURL string) error {
+	exports := make([]*DataExport, 0)
+	if err := db.NewSelect().Model(&exports).Where("status = ?", DataExportStatusPending).Order("created_at").Scan(ctx); err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		update := &DataExport{ID: export.ID, Status: DataExportStatusReady}
+
+		user, err := buildDataExport(ctx, db, dataPath, export)
+		if err != nil {
+			log.Printf("error building data export %s: %v", export.ID, err)
+			update.Status = DataExportStatusFailed
+		}
+
+		now := time.Now()
+		update.CompletedAt = &now
+		if update.Status == DataExportStatusReady {
+			expiresAt := now.Add(dataExportDuration)
+			update.ExpiresAt = &expiresAt
+		}
+
+		if _, err := db.NewUpdate().Model(update).Column("status", "completed_at", "expires_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		if update.Status == DataExportStatusReady {
+			if err := sendDataExportReadyEmail(mg, user.Email, appBaseURL+"export"); err != nil {
+				log.Printf("error sending data export %s: %v", export.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func cleanUpDataExports(ctx context.Context, db *bun.DB, dataPath string) error {
+	exports := make([]*DataExport, 0)
+	if err := db.NewSelect().Model(&exports).Where("status = ?", DataExportStatusReady).Where("expires_at <= now()").Scan(ctx); err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if err := os.Remove(dataExportPath(dataPath, export.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		update := &DataExport{ID: export.ID, Status: DataExportStatusExpired}
+		if _, err := db.NewUpdate().Model(update).Column("status").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runDataExportJobs builds the exports, right away when requested is
+// signalled, and every minute otherwise.
+func runDataExportJobs(db *bun.DB, mg mailgun.Mailgun, dataPath, appBaseURL string, requested <-chan struct{}) {
+	ticker := time.NewTicker(dataExportJobsInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := processDataExports(context.Background(), db, mg, dataPath, appBaseURL); err != nil {
+			log.Printf("error processing data exports: %v", err)
+		}
+
+		if err := cleanUpDataExports(context.Background(), db, dataPath); err != nil {
+			log.Printf("error cleaning up data exports: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-requested:
+		}
+	}
+}
+
+// checkExportingSelf refuses the impersonations and the API keys: the export
+// is mailed to the member and holds their identity documents.
+func checkExportingSelf(c *gin.Context) bool {
+	if c.GetString("impersonatorID") != "" || c.GetString("apiKeyID") != "" {
+		c.JSON(http.StatusForbidden, ErrorResponse{"Only the member can export their data.", "forbidden"})
+		return false
+	}
+
+	return true
+}
+
+func registerDataExportRoutes(authorized *gin.RouterGroup, db *bun.DB, dataPath string, requested chan<- struct{}) {
+	// Asking for the export gives the latest one, or starts a new one.
+	authorized.GET("/users/me/export", func(c *gin.Context) {
+		if !checkExportingSelf(c) {
+			return
+		}
+
+		userID := c.GetString("userID")
+
+		export := new(DataExport)
+		err := db.NewSelect().Model(export).Where("user_id = ?", userID).Where("status IN (?)", bun.In([]string{DataExportStatusPending, DataExportStatusReady})).Where("created_at > ?", time.Now().Add(-dataExportReuseDuration)).Order("created_at DESC").Limit(1).Scan(c)
+		if errors.Is(err, sql.ErrNoRows) {
+			export = &DataExport{UserID: userID, Status: DataExportStatusPending, CreatedAt: time.Now()}
+			err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewInsert().Model(export).Returning("id").Exec(ctx); err != nil {
+					return err
+				}
+
+				return writeAudit(ctx, tx, userID, c.ClientIP(), "data.export", "user", userID, map[string]interface{}{
+					"exportId": export.ID,
+				})
+			})
+			if err == nil {
+				select {
+				case requested <- struct{}{}:
+				default:
+				}
+			}
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if export.Status == DataExportStatusPending {
+			c.JSON(http.StatusAccepted, export)
+			return
+		}
+
+		c.JSON(http.StatusOK, export)
+	})
+
+	authorized.GET("/users/me/exports/:exportID", func(c *gin.Context) {
+		if !checkExportingSelf(c) {
+			return
+		}
+
+		export := new(DataExport)
+		err := db.NewSelect().Model(export).Where("id = ?", c.Param("exportID")).Where("user_id = ?", c.GetString("userID")).Where("status = ?", DataExportStatusReady).Where("expires_at > now()").Scan(c)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Export not found.", "not-found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.FileAttachment(dataExportPath(dataPath, export.ID), "entrelac-"+export.CreatedAt.Format("2006-01-02")+".zip")
+	})
+}
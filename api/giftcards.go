@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fogleman/gg"
+	"github.com/go-pdf/fpdf"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+//go:embed gift.png
+var giftImageBytes []byte
+
+//go:embed gift-en.png
+var giftImageEnglishBytes []byte
+
+//go:embed robotomono.ttf
+var robotoMonoTTF []byte
+
+const (
+	LanguageFrench  = "fr"
+	LanguageEnglish = "en"
+)
+
+const defaultGiftCardTemplate = "classic"
+
+const (
+	GiftCardFieldCode          = "code"
+	GiftCardFieldFirstName     = "first_name"
+	GiftCardFieldShares        = "shares"
+	GiftCardFieldRecipientName = "recipient_name"
+	GiftCardFieldMessage       = "message"
+	GiftCardFieldText          = "text"
+)
+
+var errGiftCardLanguage = errors.New("language not supported by the gift card template")
+
+// GiftCardTextBox is an area of a gift card in which a text is drawn. The font
+// size is reduced, down to MinSize, until the text fits in Width.
+type GiftCardTextBox struct {
+	Field   string            `json:"field"`
+	Text    map[string]string `json:"text"`
+	X       float64           `json:"x"`
+	Y       float64           `json:"y"`
+	Width   float64           `json:"width"`
+	Font    string            `json:"font"`
+	Size    float64           `json:"size"`
+	MinSize float64           `json:"minSize"`
+	Color   string            `json:"color"`
+	Align   string            `json:"align"`
+}
+
+// GiftCardTemplate describes a gift card design: one background per language
+// and the text boxes drawn on it.
+type GiftCardTemplate struct {
+	ID          string            `json:"id"`
+	Names       map[string]string `json:"names"`
+	Backgrounds map[string]string `json:"backgrounds"`
+	Boxes       []GiftCardTextBox `json:"boxes"`
+
+	images map[string]image.Image
+}
+
+type GiftCardData struct {
+	FirstName     string
+	Code          string
+	Shares        uint
+	RecipientName string
+	Message       string
+}
+
+type GiftTemplateResponseItem struct {
+	ID        string            `json:"id"`
+	Names     map[string]string `json:"names"`
+	Languages []string          `json:"languages"`
+}
+
+var giftCardFonts = map[string]*truetype.Font{}
+
+var giftCardFaces = struct {
+	sync.Mutex
+	faces map[string]font.Face
+}{faces: map[string]font.Face{}}
+
+func giftCardFace(name string, size float64) font.Face {
+	key := name + "/" + strconv.FormatFloat(size, 'f', -1, 64)
+
+	giftCardFaces.Lock()
+	defer giftCardFaces.Unlock()
+
+	face, ok := giftCardFaces.faces[key]
+	if !ok {
+		f, ok := giftCardFonts[name]
+		if !ok {
+			f = giftCardFonts["regular"]
+		}
+
+		face = truetype.NewFace(f, &truetype.Options{Size: size})
+		giftCardFaces.faces[key] = face
+	}
+
+	return face
+}
+
+func classicGiftCardTemplate() (*GiftCardTemplate, error) {
+	background, err := png.Decode(bytes.NewReader(giftImageBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	englishBackground, err := png.Decode(bytes.NewReader(giftImageEnglishBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	return &GiftCardTemplate{
+		ID:    defaultGiftCardTemplate,
+		Names: map[string]string{LanguageFrench: "Classique", LanguageEnglish: "Classic"},
+		Boxes: []GiftCardTextBox{
+			{Field: GiftCardFieldCode, X: 1149, Y: 1219, Width: 720, Font: "mono", Size: 132, MinSize: 80, Color: "074884", Align: "center"},
+			{Field: GiftCardFieldFirstName, X: 500, Y: 1000, Width: 560, Font: "bold", Size: 56, MinSize: 28, Color: "074884", Align: "left"},
+			{Field: GiftCardFieldShares, X: 614, Y: 791, Width: 90, Font: "bold", Size: 48, MinSize: 28, Color: "074884", Align: "center"},
+		},
+		images: map[string]image.Image{LanguageFrench: background, LanguageEnglish: englishBackground},
+	}, nil
+}
+
+// loadGiftCardTemplates returns the built-in template along with the ones
+// described by the JSON files of dir, whose backgrounds are PNG files of the
+// same directory.
+func loadGiftCardTemplates(dir string) (map[string]*GiftCardTemplate, error) {
+	classic, err := classicGiftCardTemplate()
+	if err != nil {
+		return nil, err
+	}
+
+	templates := map[string]*GiftCardTemplate{classic.ID: classic}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		template, err := loadGiftCardTemplate(path)
+		if err != nil {
+			return nil, fmt.Errorf("gift card template %s: %w", path, err)
+		}
+
+		templates[template.ID] = template
+	}
+
+	return templates, nil
+}
+
+func loadGiftCardTemplate(path string) (*GiftCardTemplate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	template := new(GiftCardTemplate)
+	if err := json.Unmarshal(data, template); err != nil {
+		return nil, err
+	}
+
+	template.ID = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	template.images = make(map[string]image.Image)
+
+	for language, background := range template.Backgrounds {
+		f, err := os.Open(filepath.Join(filepath.Dir(path), background))
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		template.images[language] = img
+	}
+
+	if len(template.images) == 0 {
+		return nil, errors.New("no background")
+	}
+
+	return template, nil
+}
+
+func (template *GiftCardTemplate) Languages() []string {
+	languages := make([]string, 0, len(template.images))
+	for language := range template.images {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+
+	return languages
+}
+
+func (template *GiftCardTemplate) Supports(language string) bool {
+	_, ok := template.images[language]
+	return ok
+}
+
+// fitText returns the largest face in which text fits in the box, the text
+// being shortened if it does not fit even at the minimum size.
+func (box *GiftCardTextBox) fitText(text string) (font.Face, string) {
+	minSize := box.MinSize
+	if minSize <= 0 || minSize > box.Size {
+		minSize = box.Size
+	}
+
+	for size := box.Size; size > minSize; size -= 2 {
+		face := giftCardFace(box.Font, size)
+		if box.Width <= 0 || measureText(face, text) <= box.Width {
+			return face, text
+		}
+	}
+
+	face := giftCardFace(box.Font, minSize)
+	if box.Width <= 0 || measureText(face, text) <= box.Width {
+		return face, text
+	}
+
+	runes := []rune(text)
+	for len(runes) > 0 && measureText(face, string(runes)+"…") > box.Width {
+		runes = runes[:len(runes)-1]
+	}
+
+	return face, string(runes) + "…"
+}
+
+func measureText(face font.Face, text string) float64 {
+	return float64(font.MeasureString(face, text)) / 64
+}
+
+func (template *GiftCardTemplate) Render(language string, data GiftCardData) (image.Image, error) {
+	background, ok := template.images[language]
+	if !ok {
+		return nil, errGiftCardLanguage
+	}
+
+	dc := gg.NewContextForImage(background)
+
+	for _, box := range template.Boxes {
+		var text string
+		switch box.Field {
+		case GiftCardFieldCode:
+			text = data.Code
+		case GiftCardFieldFirstName:
+			text = data.FirstName
+		case GiftCardFieldShares:
+			text = strconv.Itoa(int(data.Shares))
+		case GiftCardFieldRecipientName:
+			text = data.RecipientName
+		case GiftCardFieldMessage:
+			text = data.Message
+		case GiftCardFieldText:
+			text = box.Text[language]
+		}
+
+		if text == "" {
+			continue
+		}
+
+		face, text := box.fitText(text)
+
+		x, ax := box.X, 0.0
+		switch box.Align {
+		case "center":
+			x, ax = box.X+box.Width/2, 0.5
+		case "right":
+			x, ax = box.X+box.Width, 1
+		}
+
+		dc.SetFontFace(face)
+		dc.SetHexColor(box.Color)
+		dc.DrawStringAnchored(text, x, box.Y, ax, 0)
+	}
+
+	return dc.Image(), nil
+}
+
+// giftCardResource identifies the card of a gift in signed links.
+func giftCardResource(giftID string) string {
+	return "gifts/" + giftID
+}
+
+// renderGiftCard renders the card of a gift with the template and language
+// chosen by its buyer, falling back to the default template if it was
+// removed since. The language actually used is returned.
+func renderGiftCard(templates map[string]*GiftCardTemplate, gift *Gift, buyerFirstName string) (image.Image, string, error) {
+	template, ok := templates[gift.Template]
+	if !ok {
+		template = templates[defaultGiftCardTemplate]
+	}
+
+	language := gift.Language
+	if !template.Supports(language) {
+		language = template.Languages()[0]
+	}
+
+	data := GiftCardData{
+		FirstName: buyerFirstName,
+		Code:      gift.Code,
+		Shares:    gift.Shares,
+	}
+	if gift.RecipientName != nil {
+		data.RecipientName = *gift.RecipientName
+	}
+	if gift.Message != nil {
+		data.Message = *gift.Message
+	}
+
+	img, err := template.Render(language, data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return img, language, nil
+}
+
+// writeGiftCardPDF writes the gift card as a single page PDF, the page having
+// the proportions of the image.
+func writeGiftCardPDF(w io.Writer, img image.Image) error {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width := 297.0
+	height := width * float64(bounds.Dy()) / float64(bounds.Dx())
+
+	pdf := fpdf.NewCustom(&fpdf.InitType{
+		UnitStr: "mm",
+		Size:    fpdf.SizeType{Wd: width, Ht: height},
+	})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+
+	options := fpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader("card", options, buf)
+	pdf.ImageOptions("card", 0, 0, width, height, false, options, 0, "")
+
+	return pdf.Output(w)
+}
+
+func init() {
+	codeFont, err := truetype.Parse(robotoMonoTTF)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	boldFont, err := truetype.Parse(gobold.TTF)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	regularFont, err := truetype.Parse(goregular.TTF)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	giftCardFonts["mono"] = codeFont
+	giftCardFonts["bold"] = boldFont
+	giftCardFonts["regular"] = regularFont
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/brianvoe/gofakeit/v6"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/uptrace/bun"
+)
+
+const (
+	GiftStatusPending   = "pending"
+	GiftStatusPaid      = "paid"
+	GiftStatusClaimed   = "claimed"
+	GiftStatusExpired   = "expired"
+	GiftStatusCancelled = "cancelled"
+	// GiftStatusRevoked is a gift cancelled by an admin, which unlike an
+	// abandoned one is not revived by a late payment.
+	GiftStatusRevoked = "revoked"
+)
+
+const (
+	ShareMovementGiftSent     = "gift-sent"
+	ShareMovementGiftReceived = "gift-received"
+)
+
+var (
+	errGiftNotFound  = errors.New("gift not found")
+	errGiftNotPaid   = errors.New("gift not paid")
+	errGiftClaimed   = errors.New("gift already claimed")
+	errGiftExpired   = errors.New("gift expired")
+	errGiftSelfClaim = errors.New("gift claimed by its buyer")
+)
+
+// ShareMovement records shares moving from one member to another, outside of
+// the payments.
+type ShareMovement struct {
+	bun.BaseModel `bun:"table:share_movements"`
+
+	ID                string    `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID            string    `bun:"user_id,notnull"`
+	Shares            int       `bun:"shares,notnull"`
+	Kind              string    `bun:"kind,notnull"`
+	GiftID            *string   `bun:"gift_id"`
+	CounterpartUserID *string   `bun:"counterpart_user_id"`
+	CreatedAt         time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+// userSharesSQL computes the same total as userShares for the users aliased
+// u in a raw query.
+const userSharesSQL = "GREATEST(u.initial_shares + COALESCE((SELECT SUM(p.shares) FROM payments AS p WHERE p.user_id = u.id), 0) + COALESCE((SELECT SUM(m.shares) FROM share_movements AS m WHERE m.user_id = u.id), 0), 0)"
+
+// userShares returns the number of shares owned by a user: the initial ones,
+// the purchased ones, and the ones they were given or gave away.
+func userShares(ctx context.Context, db bun.IDB, user *User) (uint, error) {
+	var purchased int
+	err := db.NewSelect().Table("payments").ColumnExpr("COALESCE(SUM(shares), 0)").Where("user_id = ?", user.ID).Scan(ctx, &purchased)
+	if err != nil {
+		return 0, err
+	}
+
+	var moved int
+	err = db.NewSelect().Table("share_movements").ColumnExpr("COALESCE(SUM(shares), 0)").Where("user_id = ?", user.ID).Scan(ctx, &moved)
+	if err != nil {
+		return 0, err
+	}
+
+	shares := int(user.InitialShares) + purchased + moved
+	if shares < 0 {
+		return 0, nil
+	}
+
+	return uint(shares), nil
+}
+
+func newGiftCode() string {
+	return gofakeit.Regex("[ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789]{8}")
+}
+
+// checkClaimable returns why the gift cannot be claimed by the user, if it
+// cannot. An empty userID stands for a user who does not exist yet.
+func (gift *Gift) checkClaimable(userID string) error {
+	switch {
+	case gift.Status == GiftStatusClaimed:
+		return errGiftClaimed
+	case gift.Status == GiftStatusExpired || (gift.ExpiresAt != nil && gift.ExpiresAt.Before(time.Now())):
+		return errGiftExpired
+	case gift.Status == GiftStatusPending:
+		return errGiftNotPaid
+	case gift.Status != GiftStatusPaid:
+		return errGiftNotFound
+	case userID != "" && gift.BuyerUserID != nil && *gift.BuyerUserID == userID:
+		return errGiftSelfClaim
+	}
+
+	return nil
+}
+
+// checkGiftCode returns why the gift code cannot be claimed, if it cannot.
+func checkGiftCode(ctx context.Context, db bun.IDB, code string) error {
+	gift := new(Gift)
+	if err := db.NewSelect().Model(gift).Where("code = ?", code).Scan(ctx); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errGiftNotFound
+		}
+
+		return err
+	}
+
+	return gift.checkClaimable("")
+}
+
+// giftErrorResponse translates the errors of checkClaimable into responses.
+func giftErrorResponse(err error) (int, ErrorResponse, bool) {
+	switch {
+	case errors.Is(err, errGiftNotFound):
+		return http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"}, true
+	case errors.Is(err, errGiftNotPaid):
+		return http.StatusBadRequest, ErrorResponse{"This gift has not been paid yet.", "gift-not-paid"}, true
+	case errors.Is(err, errGiftClaimed):
+		return http.StatusBadRequest, ErrorResponse{"Gift Code already claimed.", "gift-code-claimed"}, true
+	case errors.Is(err, errGiftExpired):
+		return http.StatusBadRequest, ErrorResponse{"This gift code has expired.", "gift-code-expired"}, true
+	case errors.Is(err, errGiftSelfClaim):
+		return http.StatusBadRequest, ErrorResponse{"You cannot claim your own gift.", "gift-self-claim"}, true
+	}
+
+	return 0, ErrorResponse{}, false
+}
+
+// claimGift transfers the shares of a paid gift from its buyer to the user,
+// the gift row being locked for the whole transaction so that a code can only
+// be claimed once.
+func claimGift(ctx context.Context, db *bun.DB, code, userID string) (*Gift, error) {
+	gift := new(Gift)
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := tx.NewSelect().Model(gift).Where("code = ?", code).For("UPDATE").Scan(ctx); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errGiftNotFound
+			}
+
+			return err
+		}
+
+		if err := gift.checkClaimable(userID); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		gift.Status = GiftStatusClaimed
+		gift.ClaimedByUserID = &userID
+		gift.ClaimedAt = &now
+
+		if _, err := tx.NewUpdate().Model(gift).Column("status", "claimed_by_user_id", "claimed_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		movements := []*ShareMovement{
+			{
+				UserID:            userID,
+				Shares:            int(gift.Shares),
+				Kind:              ShareMovementGiftReceived,
+				GiftID:            &gift.ID,
+				CounterpartUserID: gift.BuyerUserID,
+				CreatedAt:         now,
+			},
+		}
+		if gift.BuyerUserID != nil {
+			movements = append(movements, &ShareMovement{
+				UserID:            *gift.BuyerUserID,
+				Shares:            -int(gift.Shares),
+				Kind:              ShareMovementGiftSent,
+				GiftID:            &gift.ID,
+				CounterpartUserID: &userID,
+				CreatedAt:         now,
+			})
+		}
+
+		_, err := tx.NewInsert().Model(&movements).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return gift, nil
+}
+
+func sendGiftClaimedEmail(mg mailgun.Mailgun, recipient, recipientFirstName string, shares uint) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Votre cadeau Entrelac.coop a été utilisé"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("gift-claimed")
+	err := message.AddTemplateVariable("first_name", recipientFirstName)
+	if err != nil {
+		return err
+	}
+	err = message.AddTemplateVariable("shares", strconv.Itoa(int(shares)))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func sendGiftReceivedEmail(mg mailgun.Mailgun, recipient, buyerFirstName string, shares uint) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Vous avez reçu des parts sociales Entrelac.coop"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("gift-received")
+	err := message.AddTemplateVariable("first_name", buyerFirstName)
+	if err != nil {
+		return err
+	}
+	err = message.AddTemplateVariable("shares", strconv.Itoa(int(shares)))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// notifyGiftClaimed tells both the buyer and the recipient of a gift that it
+// was claimed. Failures are only logged, the claim itself has succeeded.
+func notifyGiftClaimed(ctx context.Context, db bun.IDB, mg mailgun.Mailgun, gift *Gift) {
+	recipient := new(User)
+	if err := db.NewSelect().Model(recipient).Where("id = ?", *gift.ClaimedByUserID).Scan(ctx); err != nil {
+		log.Printf("error notifying gift claim: %v", err)
+		return
+	}
+
+	buyerFirstName := ""
+	if gift.BuyerUserID != nil {
+		buyer := new(User)
+		if err := db.NewSelect().Model(buyer).Where("id = ?", *gift.BuyerUserID).Scan(ctx); err != nil {
+			log.Printf("error notifying gift claim: %v", err)
+			return
+		}
+
+		buyerFirstName = buyer.FirstName
+
+		if err := sendGiftClaimedEmail(mg, buyer.Email, recipient.FirstName, gift.Shares); err != nil {
+			log.Printf("error sending gift claimed email: %v", err)
+		}
+	}
+
+	if err := sendGiftReceivedEmail(mg, recipient.Email, buyerFirstName, gift.Shares); err != nil {
+		log.Printf("error sending gift received email: %v", err)
+	}
+}
+
+// Stripe expires checkout sessions after 24 hours, a pending gift older than
+// that will never be paid.
+const abandonedGiftDelay = 25 * time.Hour
+
+const giftJobsInterval = 15 * time.Minute
+
+// maxGiftDeliveryAttempts is how many times the delivery of a gift is tried
+// before giving up, leaving it to an administrator to send it again. The
+// delay between two attempts doubles from giftDeliveryRetryDelay, so that
+// the last one comes more than a day after the first.
+const maxGiftDeliveryAttempts = 8
+
+const giftDeliveryRetryDelay = 15 * time.Minute
+
+// defaultGiftLinkDays is how long a link to a gift card stays valid when its
+// buyer does not say otherwise.
+const defaultGiftLinkDays = 7
+
+// Gifts are delivered at 9 o'clock, Paris time, on the day chosen by their
+// buyer.
+const giftDeliveryHour = 9
+
+var giftDeliveryLocation *time.Location
+
+func init() {
+	var err error
+	giftDeliveryLocation, err = time.LoadLocation("Europe/Paris")
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+var errGiftDeliveryDate = errors.New("gift delivery date in the past")
+
+// parseGiftDeliveryDate returns the time at which a gift should be delivered
+// on the given day, which cannot be in the past.
+func parseGiftDeliveryDate(date string) (time.Time, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, giftDeliveryLocation)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now().In(giftDeliveryLocation)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, giftDeliveryLocation)
+	if day.Before(today) {
+		return time.Time{}, errGiftDeliveryDate
+	}
+
+	deliverAt := day.Add(giftDeliveryHour * time.Hour)
+	if deliverAt.Before(now) {
+		return now, nil
+	}
+
+	return deliverAt, nil
+}
+
+// cleanUpGifts cancels the gifts whose checkout was abandoned and expires the
+// paid gifts which were not claimed in time.
+func cleanUpGifts(ctx context.Context, db bun.IDB) error {
+	result, err := db.NewUpdate().Table("gifts").Set("status = ?", GiftStatusCancelled).Where("status = ?", GiftStatusPending).Where("created_at < ?", time.Now().Add(-abandonedGiftDelay)).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("cancelled %d abandoned gifts", rows)
+	}
+
+	result, err = db.NewUpdate().Table("gifts").Set("status = ?", GiftStatusExpired).Where("status = ?", GiftStatusPaid).Where("expires_at < now()").Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		log.Printf("expired %d gifts", rows)
+	}
+
+	return nil
+}
+
+func sendGiftDeliveryEmail(mg mailgun.Mailgun, gift *Gift, buyerFirstName string, card []byte, fileName, signUpURL string) error {
+	sender := "no-reply@entrelac.coop"
+	subject := buyerFirstName + " vous offre des parts sociales Entrelac.coop"
+	if gift.Language == LanguageEnglish {
+		subject = buyerFirstName + " gave you shares of Entrelac.coop"
+	}
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, *gift.RecipientEmail)
+	message.SetTemplate("gift-delivery")
+	message.AddBufferAttachment(fileName, card)
+
+	recipientName := ""
+	if gift.RecipientName != nil {
+		recipientName = *gift.RecipientName
+	}
+
+	variables := map[string]string{
+		"language":         gift.Language,
+		"buyer_first_name": buyerFirstName,
+		"recipient_name":   recipientName,
+		"code":             gift.Code,
+		"shares":           strconv.Itoa(int(gift.Shares)),
+		"sign_up_url":      signUpURL,
+	}
+	if gift.Message != nil {
+		variables["message"] = *gift.Message
+	}
+
+	for name, value := range variables {
+		if err := message.AddTemplateVariable(name, value); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err := mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// deliverGift emails the card of a gift to its recipient, along with a sign-up
+// link pre-filling the code.
+func deliverGift(mg mailgun.Mailgun, templates map[string]*GiftCardTemplate, appBaseURL string, gift *Gift) error {
+	if gift.RecipientEmail == nil {
+		return errors.New("gift without recipient")
+	}
+
+	buyerFirstName := ""
+	if gift.Buyer != nil {
+		buyerFirstName = gift.Buyer.FirstName
+	}
+
+	img, language, err := renderGiftCard(templates, gift, buyerFirstName)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+
+	fileName := "cadeau.png"
+	if language == LanguageEnglish {
+		fileName = "gift.png"
+	}
+
+	signUpURL := appBaseURL + "signup?giftCode=" + url.QueryEscape(gift.Code)
+
+	return sendGiftDeliveryEmail(mg, gift, buyerFirstName, buf.Bytes(), fileName, signUpURL)
+}
+
+// deliverGifts emails the paid gifts whose delivery date has come.
+func deliverGifts(ctx context.Context, db bun.IDB, mg mailgun.Mailgun, templates map[string]*GiftCardTemplate, appBaseURL string) error {
+	gifts := make([]*Gift, 0)
+	err := db.NewSelect().Model(&gifts).Relation("Buyer").Where("gift.status = ?", GiftStatusPaid).Where("gift.recipient_email IS NOT NULL").Where("gift.delivered_at IS NULL").Where("gift.deliver_at <= now()").Where("gift.delivery_attempts < ?", maxGiftDeliveryAttempts).Where("gift.delivery_retry_at IS NULL OR gift.delivery_retry_at <= now()").Scan(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, gift := range gifts {
+		if err := deliverGift(mg, templates, appBaseURL, gift); err != nil {
+			log.Printf("error delivering gift %s: %v", gift.ID, err)
+			if gift.DeliveryAttempts+1 >= maxGiftDeliveryAttempts {
+				log.Printf("giving up delivering gift %s after %d attempts", gift.ID, maxGiftDeliveryAttempts)
+			}
+
+			retryAt := time.Now().Add(giftDeliveryRetryDelay << gift.DeliveryAttempts)
+			if _, err := db.NewUpdate().Table("gifts").Set("delivery_attempts = delivery_attempts + 1").Set("delivery_error = ?", err.Error()).Set("delivery_retry_at = ?", retryAt).Where("id = ?", gift.ID).Exec(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		now := time.Now()
+		update := &Gift{ID: gift.ID, DeliveredAt: &now}
+		if _, err := db.NewUpdate().Model(update).Column("delivered_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runGiftJobs(db *bun.DB, mg mailgun.Mailgun, templates map[string]*GiftCardTemplate, appBaseURL string) {
+	ticker := time.NewTicker(giftJobsInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := cleanUpGifts(context.Background(), db); err != nil {
+			log.Printf("error cleaning up gifts: %v", err)
+		}
+
+		if err := deliverGifts(context.Background(), db, mg, templates, appBaseURL); err != nil {
+			log.Printf("error delivering gifts: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/uptrace/bun"
+)
+
+type AdminGiftUser struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+}
+
+type AdminGiftResponseItem struct {
+	ID               string         `json:"id"`
+	Code             string         `json:"code"`
+	Status           string         `json:"status"`
+	Shares           uint           `json:"shares"`
+	Template         string         `json:"template"`
+	Language         string         `json:"language"`
+	Buyer            *AdminGiftUser `json:"buyer"`
+	Claimer          *AdminGiftUser `json:"claimer"`
+	RecipientName    *string        `json:"recipientName"`
+	RecipientEmail   *string        `json:"recipientEmail"`
+	CreatedAt        time.Time      `json:"createdAt"`
+	PaidAt           *time.Time     `json:"paidAt"`
+	ClaimedAt        *time.Time     `json:"claimedAt"`
+	ExpiresAt        *time.Time     `json:"expiresAt"`
+	DeliverAt        *time.Time     `json:"deliverAt"`
+	DeliveredAt      *time.Time     `json:"deliveredAt"`
+	DeliveryAttempts uint           `json:"deliveryAttempts"`
+	DeliveryError    *string        `json:"deliveryError"`
+}
+
+type AdminRevokeGiftRequest struct {
+	Reason string `json:"reason" binding:"required"`
+}
+
+type AdminResendGiftRequest struct {
+	Email *string `json:"email" binding:"omitempty,email"`
+}
+
+func newAdminGiftUser(user *User) *AdminGiftUser {
+	if user == nil {
+		return nil
+	}
+
+	return &AdminGiftUser{
+		ID:        user.ID,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+	}
+}
+
+func newAdminGiftResponseItem(gift *Gift) *AdminGiftResponseItem {
+	return &AdminGiftResponseItem{
+		ID:               gift.ID,
+		Code:             gift.Code,
+		Status:           gift.Status,
+		Shares:           gift.Shares,
+		Template:         gift.Template,
+		Language:         gift.Language,
+		Buyer:            newAdminGiftUser(gift.Buyer),
+		Claimer:          newAdminGiftUser(gift.Claimer),
+		RecipientName:    gift.RecipientName,
+		RecipientEmail:   gift.RecipientEmail,
+		CreatedAt:        gift.CreatedAt,
+		PaidAt:           gift.PaidAt,
+		ClaimedAt:        gift.ClaimedAt,
+		ExpiresAt:        gift.ExpiresAt,
+		DeliverAt:        gift.DeliverAt,
+		DeliveredAt:      gift.DeliveredAt,
+		DeliveryAttempts: gift.DeliveryAttempts,
+		DeliveryError:    gift.DeliveryError,
+	}
+}
+
+// whereGiftUser filters the gifts on the user joined as relation, given either
+// their ID or a part of their email address.
+func whereGiftUser(query *bun.SelectQuery, relation, column, value string) *bun.SelectQuery {
+	if _, err := uuid.Parse(value); err == nil {
+		return query.Where("gift.? = ?", bun.Ident(column), value)
+	}
+
+	return query.Where("?.email ILIKE ?", bun.Ident(relation), "%"+value+"%")
+}
+
+func registerGiftAdminRoutes(admin *gin.RouterGroup, db *bun.DB, mg mailgun.Mailgun, templates map[string]*GiftCardTemplate, appBaseURL string) {
+	selectGift := func(ctx context.Context, giftID string) (*Gift, error) {
+		gift := new(Gift)
+		err := db.NewSelect().Model(gift).Relation("Buyer").Relation("Claimer").Where("gift.id = ?", giftID).Scan(ctx)
+		return gift, err
+	}
+
+	respondGiftNotFound := func(c *gin.Context, err error) {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"})
+			return
+		}
+
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+	}
+
+	admin.GET("/gifts", func(c *gin.Context) {
+		gifts := make([]*Gift, 0)
+		query := db.NewSelect().Model(&gifts).Relation("Buyer").Relation("Claimer").Order("gift.created_at DESC")
+
+		if status := c.Query("status"); status != "" {
+			query = query.Where("gift.status = ?", status)
+		}
+		if buyer := c.Query("buyer"); buyer != "" {
+			query = whereGiftUser(query, "buyer", "buyer_user_id", buyer)
+		}
+		if claimer := c.Query("claimer"); claimer != "" {
+			query = whereGiftUser(query, "claimer", "claimed_by_user_id", claimer)
+		}
+
+		if err := query.Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*AdminGiftResponseItem, 0, len(gifts))
+		for _, gift := range gifts {
+			response = append(response, newAdminGiftResponseItem(gift))
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admin.GET("/gifts/:giftID", func(c *gin.Context) {
+		gift, err := selectGift(c, c.Param("giftID"))
+		if err != nil {
+			respondGiftNotFound(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, newAdminGiftResponseItem(gift))
+	})
+
+	admin.POST("/gifts/:giftID/revoke", func(c *gin.Context) {
+		var json AdminRevokeGiftRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		gift, err := selectGift(c, c.Param("giftID"))
+		if err != nil {
+			respondGiftNotFound(c, err)
+			return
+		}
+
+		if gift.Status != GiftStatusPending && gift.Status != GiftStatusPaid {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Only a gift which has not been claimed can be revoked.", "gift-not-revocable"})
+			return
+		}
+
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			update := &Gift{ID: gift.ID, Status: GiftStatusRevoked}
+			result, err := tx.NewUpdate().Model(update).Column("status").WherePK().Where("status = ?", gift.Status).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				return errGiftClaimed
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "gift.revoke", "gift", gift.ID, map[string]interface{}{
+				"status": gift.Status,
+				"reason": json.Reason,
+			})
+		})
+		if errors.Is(err, errGiftClaimed) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Only a gift which has not been claimed can be revoked.", "gift-not-revocable"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		gift.Status = GiftStatusRevoked
+
+		c.JSON(http.StatusOK, newAdminGiftResponseItem(gift))
+	})
+
+	// Reissuing replaces the code of a paid gift, for instance when the card
+	// was sent to the wrong person: the old code cannot be claimed anymore.
+	admin.POST("/gifts/:giftID/reissue", func(c *gin.Context) {
+		gift, err := selectGift(c, c.Param("giftID"))
+		if err != nil {
+			respondGiftNotFound(c, err)
+			return
+		}
+
+		if gift.Status != GiftStatusPaid {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Only a paid gift which has not been claimed can be reissued.", "gift-not-reissuable"})
+			return
+		}
+
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			update := &Gift{ID: gift.ID, Code: newGiftCode()}
+			result, err := tx.NewUpdate().Model(update).Column("code").WherePK().Where("status = ?", GiftStatusPaid).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				return errGiftClaimed
+			}
+
+			gift.Code = update.Code
+
+			// The codes stay out of the audit log: the new one can still be
+			// claimed.
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "gift.reissue", "gift", gift.ID, nil)
+		})
+		if errors.Is(err, errGiftClaimed) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Only a paid gift which has not been claimed can be reissued.", "gift-not-reissuable"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newAdminGiftResponseItem(gift))
+	})
+
+	admin.POST("/gifts/:giftID/resend", func(c *gin.Context) {
+		var json AdminResendGiftRequest
+		if err := c.ShouldBindJSON(&json); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		gift, err := selectGift(c, c.Param("giftID"))
+		if err != nil {
+			respondGiftNotFound(c, err)
+			return
+		}
+
+		if gift.Status != GiftStatusPaid {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Only a paid gift which has not been claimed can be sent.", "gift-not-sendable"})
+			return
+		}
+
+		if json.Email != nil {
+			gift.RecipientEmail = json.Email
+		}
+
+		if gift.RecipientEmail == nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This gift has no recipient, an email address is required.", "gift-recipient-missing"})
+			return
+		}
+
+		if err := deliverGift(mg, templates, appBaseURL, gift); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		now := time.Now()
+		update := &Gift{ID: gift.ID, DeliveredAt: &now}
+		if _, err := db.NewUpdate().Model(update).Column("delivered_at", "delivery_attempts", "delivery_error", "delivery_retry_at").WherePK().Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		gift.DeliveredAt = &now
+		gift.DeliveryAttempts = 0
+		gift.DeliveryError = nil
+		gift.DeliveryRetryAt = nil
+
+		err = writeAudit(c, db, c.GetString("userID"), c.ClientIP(), "gift.resend", "gift", gift.ID, map[string]interface{}{
+			"email": *gift.RecipientEmail,
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newAdminGiftResponseItem(gift))
+	})
+}
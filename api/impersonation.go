@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+// To answer support requests, admins can see the member pages as a member
+// sees them, through a read-only session which cannot be refreshed.
+func registerImpersonationRoutes(members *gin.RouterGroup, db *bun.DB, keys *auth.KeySet) {
+	members.POST("/users/:userID/impersonate", func(c *gin.Context) {
+		adminID := c.GetString("userID")
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.Param("userID")).Scan(c); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this ID.", "id-unknown"})
+				return
+			}
+
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if user.ID == adminID {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"You cannot impersonate yourself.", "impersonating-self"})
+			return
+		}
+
+		// The refresh token of the session is never given out.
+		refreshToken, err := auth.NewRefreshToken()
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		session := &Session{
+			UserID:             user.ID,
+			RefreshTokenHash:   auth.HashToken(refreshToken),
+			UserAgent:          c.Request.UserAgent(),
+			IP:                 c.ClientIP(),
+			ExpiresAt:          time.Now().Add(auth.ImpersonationDuration),
+			ImpersonatorUserID: &adminID,
+		}
+
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.NewInsert().Model(session).Returning("id").Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, adminID, c.ClientIP(), "user.impersonate", "user", user.ID, map[string]interface{}{
+				"sessionId": session.ID,
+				"expiresAt": session.ExpiresAt,
+			})
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		token, err := auth.NewImpersonationToken(keys, session.ID, user.ID, adminID, session.ExpiresAt)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"token":     token,
+			"sessionId": session.ID,
+			"expiresAt": session.ExpiresAt,
+		})
+	})
+
+	members.DELETE("/impersonations/:sessionID", func(c *gin.Context) {
+		adminID := c.GetString("userID")
+
+		session := new(Session)
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			err := tx.NewSelect().Model(session).Where("id = ?", c.Param("sessionID")).Where("impersonator_user_id = ?", adminID).Where("revoked_at IS NULL").For("UPDATE").Scan(ctx)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.NewUpdate().Model(session).Set("revoked_at = now()").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, adminID, c.ClientIP(), "user.impersonate.end", "user", session.UserID, map[string]interface{}{
+				"sessionId": session.ID,
+			})
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Impersonation not found.", "not-found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
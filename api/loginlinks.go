@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/mailgun/mailgun-go/v4"
+	"github.com/uptrace/bun"
+)
+
+const loginLinkDuration = 10 * time.Minute
+
+type LoginLink struct {
+	bun.BaseModel `bun:"table:login_links"`
+
+	ID        string     `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID    string     `bun:"user_id,notnull"`
+	CreatedAt time.Time  `bun:"created_at,notnull,default:current_timestamp"`
+	ExpiresAt time.Time  `bun:"expires_at,notnull"`
+	UsedAt    *time.Time `bun:"used_at"`
+}
+
+type StartLoginLinkRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type LoginLinkRequest struct {
+	ID           string `json:"id" binding:"required"`
+	Expires      int64  `json:"expires" binding:"required"`
+	Signature    string `json:"signature" binding:"required"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func loginLinkResource(linkID string) string {
+	return "login-links/" + linkID
+}
+
+// loginLinkURL returns the page of the app which logs in with the link.
+func loginLinkURL(key []byte, appBaseURL string, link *LoginLink) string {
+	values := url.Values{}
+	values.Set("id", link.ID)
+	values.Set("expires", strconv.FormatInt(link.ExpiresAt.Unix(), 10))
+	values.Set("signature", auth.Sign(key, loginLinkResource(link.ID), link.ExpiresAt))
+
+	return appBaseURL + "login-link?" + values.Encode()
+}
+
+func registerLoginLinkRoutes(r *gin.Engine, db *bun.DB, mg mailgun.Mailgun, key []byte, keys *auth.KeySet, appBaseURL string) {
+	r.POST("/users/login-link/start", func(c *gin.Context) {
+		var json StartLoginLinkRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		ipKey := ipThrottleKey(c)
+		if !checkThrottle(c, db, ipKey) {
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("email = ?", json.Email).Scan(c); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+					log.Println(err)
+				}
+
+				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this email address.", "email-unknown"})
+				return
+			}
+
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		accountKey := accountThrottleKey("login-link", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		// Every email sent counts as an attempt, so that the route cannot be
+		// used to flood a mailbox.
+		if _, err := recordFailedAttempt(c, db, accountKey, ipKey); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if _, err := db.NewDelete().Table("login_links").Where("expires_at < now()").Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		link := &LoginLink{
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(loginLinkDuration),
+		}
+		if _, err := db.NewInsert().Model(link).Returning("id").Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := sendLoginLinkEmail(mg, user.Email, loginLinkURL(key, appBaseURL, link)); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	// Following the link proves access to the mailbox: it confirms the
+	// account, but is not enough to get past two-factor authentication.
+	r.POST("/users/login-link", func(c *gin.Context) {
+		var json LoginLinkRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		ipKey := ipThrottleKey(c)
+		if !checkThrottle(c, db, ipKey) {
+			return
+		}
+
+		if !auth.CheckSignature(key, loginLinkResource(json.ID), json.Expires, json.Signature) {
+			if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This link is invalid or has expired.", "login-link-invalid"})
+			return
+		}
+
+		link := new(LoginLink)
+		err := db.NewSelect().Model(link).Where("id = ?", json.ID).Where("used_at IS NULL").Where("expires_at > now()").Scan(c)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This link is invalid or has expired.", "login-link-invalid"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", link.UserID).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		accountKey := accountThrottleKey("login", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		// The link is only used once the second factor is given, so that it
+		// can be followed again with the code.
+		if !checkSecondFactor(c, db, key, user, json.TOTPCode, json.RecoveryCode, accountKey, ipKey) {
+			return
+		}
+
+		result, err := db.NewUpdate().Table("login_links").Set("used_at = now()").Where("id = ?", link.ID).Where("used_at IS NULL").Exec(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This link is invalid or has expired.", "login-link-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		wasConfirmed := user.Confirmed
+		if !wasConfirmed {
+			if err := confirmAccount(c, db, user); err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
+		response, err := startSession(c, db, keys, user, user.TOTPEnabledAt != nil)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if !wasConfirmed {
+			claimPendingGift(c, db, mg, user, response)
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+}
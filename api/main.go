@@ -8,27 +8,27 @@ import (
 	"encoding/csv"
 	"encoding/json"
 	"errors"
-	"image"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
-	"github.com/brianvoe/gofakeit/v6"
-	"github.com/fogleman/gg"
 	"github.com/getsentry/sentry-go"
 	sentrygin "github.com/getsentry/sentry-go/gin"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	_ "github.com/golang-jwt/jwt/v4"
-	"github.com/golang/freetype/truetype"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -41,20 +41,8 @@ import (
 	"github.com/uptrace/bun/dialect/pgdialect"
 	"github.com/uptrace/bun/driver/pgdriver"
 	"github.com/uptrace/bun/migrate"
-	"golang.org/x/image/font"
-	"golang.org/x/image/font/gofont/gobold"
 )
 
-//go:embed gift.png
-var giftImageBytes []byte
-
-//go:embed robotomono.ttf
-var robotoMonoTTF []byte
-var giftImage image.Image
-var codeFace font.Face
-var firstNameFace font.Face
-var sharesFace font.Face
-
 func sendConfirmAccountEmail(mg mailgun.Mailgun, recipient, token string) error {
 	sender := "no-reply@entrelac.coop"
 	subject := "Confirmer votre compte Entrelac.coop"
@@ -101,31 +89,151 @@ func sendResetAccountEmail(mg mailgun.Mailgun, recipient, token string) error {
 	return nil
 }
 
+func sendLoginLinkEmail(mg mailgun.Mailgun, recipient, url string) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Se connecter à Entrelac.coop"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("login-link")
+	err := message.AddTemplateVariable("url", url)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func sendChangeEmailEmail(mg mailgun.Mailgun, recipient, token string) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Confirmer votre nouvelle adresse email Entrelac.coop"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("change-email")
+	err := message.AddTemplateVariable("token", token)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func sendEmailChangeNoticeEmail(mg mailgun.Mailgun, recipient, newEmail string) error {
+	sender := "no-reply@entrelac.coop"
+	subject := "Changement de l'adresse email de votre compte Entrelac.coop"
+	body := ""
+
+	message := mg.NewMessage(sender, subject, body, recipient)
+	message.SetTemplate("email-change-notice")
+	err := message.AddTemplateVariable("newEmail", newEmail)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, _, err = mg.Send(ctx, message)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func rehashPassword(ctx context.Context, db bun.IDB, user *User, password string) error {
+	passwordHash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	update := &User{ID: user.ID, Password: passwordHash}
+	_, err = db.NewUpdate().Model(update).Column("password").WherePK().Where("password = ?", user.Password).Exec(ctx)
+	return err
+}
+
+func confirmAccount(ctx context.Context, db bun.IDB, user *User) error {
+	update := &User{ID: user.ID, Confirmed: true, ConfirmToken: nil, ConfirmTokenExpiresAt: nil, PendingGiftCode: nil}
+	_, err := db.NewUpdate().Model(update).Column("confirmed", "confirm_token", "confirm_token_expires_at", "pending_gift_code").WherePK().Exec(ctx)
+	return err
+}
+
+// claimPendingGift claims the gift code given at sign-up, now that the account
+// exists for good. It may have been claimed by someone else since, which must
+// not prevent the confirmation: the outcome is only added to response.
+func claimPendingGift(c *gin.Context, db *bun.DB, mg mailgun.Mailgun, user *User, response gin.H) {
+	if user.PendingGiftCode == nil {
+		return
+	}
+
+	gift, err := claimGift(c, db, *user.PendingGiftCode, user.ID)
+	if err != nil {
+		if _, giftError, ok := giftErrorResponse(err); ok {
+			response["giftError"] = giftError.Code
+		} else {
+			log.Println(err)
+			response["giftError"] = "internal"
+		}
+		return
+	}
+
+	response["giftShares"] = gift.Shares
+	go notifyGiftClaimed(context.Background(), db, mg, gift)
+}
+
 type User struct {
 	bun.BaseModel `bun:"table:users"`
 
-	ID            string  `bun:"id,pk,type:uuid,default:gen_new_uuid()" json:"id"`
-	Admin         bool    `bun:"admin,notnull,default:false" json:"admin"`
-	Confirmed     bool    `bun:"confirmed,notnull,default:false" json:"confirmed"`
-	ConfirmToken  *string `bun:"confirm_token"`
-	ResetToken    *string `bun:"reset_token"`
-	Email         string  `bun:"email,unique,notnull" json:"email"`
-	Password      string  `bun:"password,notnull"`
-	PhoneNumber   string  `bun:"phone_number,notnull" json:"phoneNumber"`
-	FirstName     string  `bun:"first_name,notnull" json:"firstName"`
-	LastName      string  `bun:"last_name,notnull" json:"lastName"`
-	Address       string  `bun:"address,notnull" json:"address"`
-	PostalCode    string  `bun:"postal_code,notnull" json:"postalCode"`
-	City          string  `bun:"city,notnull" json:"city"`
-	Country       string  `bun:"country,notnull" json:"country"`
-	Category      string  `bun:"category,notnull" json:"category"`
-	Reason        *string `bun:"reason" json:"reason"`
-	Customer      string  `bun:"customer,notnull" json:"customer"`
-	IdentityFront *string `bun:"identity_front" json:"identityFront"`
-	IdentityBack  *string `bun:"identity_back" json:"identityBack"`
-	AddressProof  *string `bun:"address_proof" json:"addressProof"`
-	Accepted      bool    `bun:"accepted,notnull,default:false" json:"accepted"`
-	InitialShares uint    `bun:"initial_shares,notnull,default:0" json:"initialShares"`
+	ID                        string     `bun:"id,pk,type:uuid,default:gen_new_uuid()" json:"id"`
+	Roles                     []string   `bun:"roles,array,notnull,default:'{}'" json:"roles"`
+	Confirmed                 bool       `bun:"confirmed,notnull,default:false" json:"confirmed"`
+	ConfirmToken              *string    `bun:"confirm_token"`
+	ConfirmTokenExpiresAt     *time.Time `bun:"confirm_token_expires_at"`
+	ResetToken                *string    `bun:"reset_token"`
+	ResetTokenExpiresAt       *time.Time `bun:"reset_token_expires_at"`
+	NewEmail                  *string    `bun:"new_email"`
+	EmailChangeToken          *string    `bun:"email_change_token"`
+	EmailChangeTokenExpiresAt *time.Time `bun:"email_change_token_expires_at"`
+	TOTPSecret                *string    `bun:"totp_secret"`
+	TOTPEnabledAt             *time.Time `bun:"totp_enabled_at"`
+	TOTPLastStep              *int64     `bun:"totp_last_step"`
+	Email                     string     `bun:"email,unique,notnull" json:"email"`
+	Password                  string     `bun:"password,notnull"`
+	PhoneNumber               string     `bun:"phone_number,notnull" json:"phoneNumber"`
+	FirstName                 string     `bun:"first_name,notnull" json:"firstName"`
+	LastName                  string     `bun:"last_name,notnull" json:"lastName"`
+	Address                   string     `bun:"address,notnull" json:"address"`
+	PostalCode                string     `bun:"postal_code,notnull" json:"postalCode"`
+	City                      string     `bun:"city,notnull" json:"city"`
+	Country                   string     `bun:"country,notnull" json:"country"`
+	Category                  string     `bun:"category,notnull" json:"category"`
+	Reason                    *string    `bun:"reason" json:"reason"`
+	Customer                  string     `bun:"customer,notnull" json:"customer"`
+	IdentityFront             *string    `bun:"identity_front" json:"identityFront"`
+	IdentityBack              *string    `bun:"identity_back" json:"identityBack"`
+	AddressProof              *string    `bun:"address_proof" json:"addressProof"`
+	Accepted                  bool       `bun:"accepted,notnull,default:false" json:"accepted"`
+	InitialShares             uint       `bun:"initial_shares,notnull,default:0" json:"initialShares"`
+	PendingGiftCode           *string    `bun:"pending_gift_code" json:"-"`
+	ErasureRequestedAt        *time.Time `bun:"erasure_requested_at" json:"erasureRequestedAt"`
+	ErasedAt                  *time.Time `bun:"erased_at" json:"erasedAt"`
 
 	Payments []*Payment `bun:"rel:has-many,join:id=user_id"`
 }
@@ -139,6 +247,7 @@ type Payment struct {
 	CreatedAt     time.Time `bun:"created_at,notnull"`
 	UserID        string    `bun:"user_id,notnull"`
 	GiftID        *string   `bun:"gift_id,unique"`
+	CampaignID    *string   `bun:"campaign_id"`
 
 	User *User `bun:"rel:belongs-to,join:user_id=id"`
 }
@@ -146,11 +255,31 @@ type Payment struct {
 type Gift struct {
 	bun.BaseModel `bun:"table:gifts"`
 
-	ID              string  `bun:"id,pk,type:uuid,default:gen_new_uuid()"`
-	Code            string  `bun:"code,unique,notnull"`
-	ClaimedByUserID *string `bun:"claimed_by_user_id"`
+	ID                string     `bun:"id,pk,type:uuid,default:gen_new_uuid()"`
+	Code              string     `bun:"code,unique,notnull"`
+	Status            string     `bun:"status,notnull,default:'pending'"`
+	BuyerUserID       *string    `bun:"buyer_user_id"`
+	Shares            uint       `bun:"shares,notnull"`
+	CheckoutSessionID *string    `bun:"checkout_session_id"`
+	ClaimedByUserID   *string    `bun:"claimed_by_user_id"`
+	ClaimedAt         *time.Time `bun:"claimed_at"`
+	CreatedAt         time.Time  `bun:"created_at,notnull,default:current_timestamp"`
+	PaidAt            *time.Time `bun:"paid_at"`
+	ExpiresAt         *time.Time `bun:"expires_at"`
+	Template          string     `bun:"template,notnull,default:'classic'"`
+	Language          string     `bun:"language,notnull,default:'fr'"`
+	RecipientName     *string    `bun:"recipient_name"`
+	RecipientEmail    *string    `bun:"recipient_email"`
+	Message           *string    `bun:"message"`
+	DeliverAt         *time.Time `bun:"deliver_at"`
+	DeliveredAt       *time.Time `bun:"delivered_at"`
+	DeliveryAttempts  uint       `bun:"delivery_attempts,notnull,default:0"`
+	DeliveryError     *string    `bun:"delivery_error"`
+	DeliveryRetryAt   *time.Time `bun:"delivery_retry_at"`
 
 	Payment *Payment `bun:"rel:has-one,join:id=gift_id"`
+	Buyer   *User    `bun:"rel:belongs-to,join:buyer_user_id=id"`
+	Claimer *User    `bun:"rel:belongs-to,join:claimed_by_user_id=id"`
 }
 
 type ErrorResponse struct {
@@ -170,11 +299,17 @@ type CreateUserRequest struct {
 	Country     string  `json:"country" binding:"required"`
 	Category    string  `json:"category" binding:"required"`
 	Reason      *string `json:"reason" binding:"required_unless=Category supporters"`
+	GiftCode    *string `json:"gift_code"`
 }
 
+// CreateTokenRequest logs in either with an email and a password, or with a
+// passkey.
 type CreateTokenRequest struct {
-	Email    string `json:"email" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Email        string            `json:"email" binding:"required_without=Passkey"`
+	Password     string            `json:"password" binding:"required_without=Passkey"`
+	TOTPCode     string            `json:"totp_code"`
+	RecoveryCode string            `json:"recovery_code"`
+	Passkey      *PasskeyAssertion `json:"passkey"`
 }
 
 type ConfirmUserRequest struct {
@@ -187,9 +322,11 @@ type StartConfirmUserRequest struct {
 }
 
 type ResetUserRequest struct {
-	Email    string `json:"email" binding:"required"`
-	Password string `json:"password" binding:"required"`
-	Token    string `json:"token" binding:"required"`
+	Email        string `json:"email" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	Token        string `json:"token" binding:"required"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
 }
 
 type StartResetUserRequest struct {
@@ -265,23 +402,25 @@ type AdminGetUsersResponseItem struct {
 }
 
 type AdminGetUserResponse struct {
-	ID            string  `json:"id"`
-	Confirmed     bool    `json:"confirmed"`
-	Admin         bool    `json:"admin"`
-	Email         string  `json:"email"`
-	FirstName     string  `json:"firstName"`
-	LastName      string  `json:"lastName"`
-	PhoneNumber   string  `json:"phoneNumber"`
-	Address       string  `json:"address"`
-	PostalCode    string  `json:"postalCode"`
-	City          string  `json:"city"`
-	Country       string  `json:"country"`
-	Category      string  `json:"category"`
-	Reason        *string `json:"reason"`
-	IdentityFront *string `json:"identityFront"`
-	IdentityBack  *string `json:"identityBack"`
-	AddressProof  *string `json:"addressProof"`
-	Shares        uint    `json:"shares"`
+	ID                 string     `json:"id"`
+	Confirmed          bool       `json:"confirmed"`
+	Roles              []string   `json:"roles"`
+	Email              string     `json:"email"`
+	FirstName          string     `json:"firstName"`
+	LastName           string     `json:"lastName"`
+	PhoneNumber        string     `json:"phoneNumber"`
+	Address            string     `json:"address"`
+	PostalCode         string     `json:"postalCode"`
+	City               string     `json:"city"`
+	Country            string     `json:"country"`
+	Category           string     `json:"category"`
+	Reason             *string    `json:"reason"`
+	IdentityFront      *string    `json:"identityFront"`
+	IdentityBack       *string    `json:"identityBack"`
+	AddressProof       *string    `json:"addressProof"`
+	Shares             uint       `json:"shares"`
+	ErasureRequestedAt *time.Time `json:"erasureRequestedAt"`
+	ErasedAt           *time.Time `json:"erasedAt"`
 }
 
 type UploadDocumentsForm struct {
@@ -290,69 +429,35 @@ type UploadDocumentsForm struct {
 	AddressProof  *multipart.FileHeader `form:"address_proof" binding:"required"`
 }
 
+type CreateGiftLinkRequest struct {
+	Days uint `json:"days" binding:"omitempty,max=30"`
+}
+
 type CreateCheckoutSessionRequest struct {
-	Quantity uint `json:"quantity" binding:"required"`
-	Gift     bool `json:"gift"`
+	Quantity     uint   `json:"quantity" binding:"required"`
+	Gift         bool   `json:"gift"`
+	GiftTemplate string `json:"gift_template"`
+	GiftLanguage string `json:"gift_language" binding:"omitempty,oneof=fr en"`
+
+	RecipientName  *string `json:"recipient_name" binding:"required_with=RecipientEmail"`
+	RecipientEmail *string `json:"recipient_email" binding:"omitempty,email"`
+	Message        *string `json:"message" binding:"omitempty,max=500"`
+	DeliveryDate   *string `json:"delivery_date" binding:"omitempty,datetime=2006-01-02"`
 }
 
+// minimumShares is the number of shares a member must own for their
+// application to be complete.
+const minimumShares = 1
+
 var Migrations = migrate.NewMigrations()
 
 //go:embed migrations/*.sql
 var sqlMigrations embed.FS
 
-func generateGiftCard(firstName string, code string, shares uint) image.Image {
-	codeX := 1149.0 + 30.0
-	codeY := 1072.0 + 193.0 - 46
-
-	firstNameX := 480.0 + 20.0
-	firstNameY := 1000.0
-
-	sharesX := 624.0
-	sharesY := 791.0
-
-	dc := gg.NewContextForImage(giftImage)
-
-	dc.SetFontFace(codeFace)
-	dc.SetHexColor("074884")
-	dc.DrawString(code, codeX, codeY)
-
-	dc.SetFontFace(firstNameFace)
-	dc.SetHexColor("074884")
-	dc.DrawString(firstName, firstNameX, firstNameY)
-
-	dc.SetFontFace(sharesFace)
-	dc.SetHexColor("074884")
-	dc.DrawString(strconv.Itoa(int(shares)), sharesX, sharesY)
-
-	return dc.Image()
-}
-
 func init() {
 	if err := Migrations.Discover(sqlMigrations); err != nil {
 		log.Fatal(err)
 	}
-
-	var err error
-	giftImage, err = png.Decode(bytes.NewReader(giftImageBytes))
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	codeFont, err := truetype.Parse(robotoMonoTTF)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	codeFace = truetype.NewFace(codeFont, &truetype.Options{Size: 132})
-
-	firstNameFont, err := truetype.Parse(gobold.TTF)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	firstNameFace = truetype.NewFace(firstNameFont, &truetype.Options{Size: 56})
-
-	sharesFace = truetype.NewFace(firstNameFont, &truetype.Options{Size: 48})
 }
 
 func main() {
@@ -367,14 +472,94 @@ func main() {
 	dataPath := os.Getenv("DATA_PATH")
 	dsn := os.Getenv("DSN")
 	appBaseURL := os.Getenv("APP_BASE_URL")
+	apiBaseURL := os.Getenv("API_BASE_URL")
 	key := []byte(os.Getenv("KEY"))
 
+	var giftValidity time.Duration
+	if giftValidityDays := os.Getenv("GIFT_VALIDITY_DAYS"); giftValidityDays != "" {
+		days, err := strconv.Atoi(giftValidityDays)
+		if err != nil {
+			log.Fatalf("error parsing GIFT_VALIDITY_DAYS: %v", err)
+		}
+
+		giftValidity = time.Duration(days) * 24 * time.Hour
+	}
+
+	auditRetention := defaultAuditRetention
+	if auditRetentionDays := os.Getenv("AUDIT_RETENTION_DAYS"); auditRetentionDays != "" {
+		days, err := strconv.Atoi(auditRetentionDays)
+		if err != nil {
+			log.Fatalf("error parsing AUDIT_RETENTION_DAYS: %v", err)
+		}
+		if days <= 0 {
+			log.Fatalf("error checking AUDIT_RETENTION_DAYS: %d days is not a positive duration", days)
+		}
+
+		auditRetention = time.Duration(days) * 24 * time.Hour
+	}
+
+	for name, param := range map[string]*uint32{
+		"ARGON2_MEMORY": &auth.PasswordParams.Memory,
+		"ARGON2_TIME":   &auth.PasswordParams.Time,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				log.Fatalf("error parsing %s: %v", name, err)
+			}
+
+			*param = uint32(n)
+		}
+	}
+
+	if argon2Threads := os.Getenv("ARGON2_THREADS"); argon2Threads != "" {
+		n, err := strconv.ParseUint(argon2Threads, 10, 8)
+		if err != nil {
+			log.Fatalf("error parsing ARGON2_THREADS: %v", err)
+		}
+
+		auth.PasswordParams.Threads = uint8(n)
+	}
+
+	if err := auth.PasswordParams.Validate(); err != nil {
+		log.Fatalf("error checking ARGON2_MEMORY, ARGON2_TIME and ARGON2_THREADS: %v", err)
+	}
+
 	if err := os.MkdirAll(filepath.Join(dataPath, "uploads"), os.ModePerm); err != nil {
 		log.Fatalf("error creating uploads directory: %v", err)
 	}
 
+	if err := os.MkdirAll(filepath.Join(dataPath, "exports"), os.ModePerm); err != nil {
+		log.Fatalf("error creating exports directory: %v", err)
+	}
+
+	giftCardTemplates, err := loadGiftCardTemplates(filepath.Join(dataPath, "gift-templates"))
+	if err != nil {
+		log.Fatalf("error loading gift card templates: %v", err)
+	}
+
+	keysPath := os.Getenv("KEYS_PATH")
+	if keysPath == "" {
+		keysPath = filepath.Join(dataPath, "keys")
+	}
+
+	keys, err := auth.LoadKeySet(keysPath)
+	if err != nil {
+		log.Fatalf("error loading signing keys: %v", err)
+	}
+
+	wa, err := newWebAuthn(appBaseURL)
+	if err != nil {
+		log.Fatalf("error configuring WebAuthn: %v", err)
+	}
+
 	stripe.Key = stripeKey
 
+	sharePrice.priceID = stripePrice
+	if _, err := sharePrice.get(); err != nil {
+		log.Printf("error loading STRIPE_PRICE, retrying when needed: %v", err)
+	}
+
 	mg := mailgun.NewMailgun(mailgunDomain, mailgunKey)
 	mg.SetAPIBase(mailgunAPIBase)
 
@@ -397,6 +582,15 @@ func main() {
 		log.Printf("migrated to %s", group)
 	}
 
+	go runGiftJobs(db, mg, giftCardTemplates, appBaseURL)
+	go runAuthAttemptsCleanUp(db)
+	go runAuditLogCleanUp(db, auditRetention)
+
+	dataExportRequested := make(chan struct{}, 1)
+	go runDataExportJobs(db, mg, dataPath, appBaseURL, dataExportRequested)
+
+	validateSession := sessionValidator(db)
+
 	r := gin.Default()
 
 	if gin.Mode() == gin.ReleaseMode {
@@ -423,9 +617,51 @@ func main() {
 			return
 		}
 
+		ipKey := ipThrottleKey(c)
+		if !checkThrottle(c, db, ipKey) {
+			return
+		}
+
+		// Passkeys require user verification: they count as two factors.
+		if json.Passkey != nil {
+			user, err := loginWithPasskey(c, db, wa, json.Passkey)
+			if errors.Is(err, errPasskeyChallenge) || errors.Is(err, errPasskeyInvalid) {
+				if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+					log.Println(err)
+				}
+
+				c.JSON(http.StatusBadRequest, ErrorResponse{"This passkey is invalid.", "passkey-invalid"})
+				return
+			}
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+
+			if !user.Confirmed {
+				c.JSON(http.StatusUnauthorized, ErrorResponse{"This account is not confirmed.", "not-confirmed"})
+				return
+			}
+
+			response, err := startSession(c, db, keys, user, true)
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
 		user := new(User)
 		if err := db.NewSelect().Model(user).Where("email = ?", json.Email).Scan(c); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+					log.Println(err)
+				}
+
 				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this email address.", "email-unknown"})
 				return
 			}
@@ -435,7 +671,16 @@ func main() {
 			return
 		}
 
+		accountKey := accountThrottleKey("login", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
 		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey, ipKey); err != nil {
+				log.Println(err)
+			}
+
 			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
 			return
 		}
@@ -445,13 +690,30 @@ func main() {
 			return
 		}
 
-		token, err := auth.NewToken(key, user.ID, user.Admin)
+		if !checkSecondFactor(c, db, key, user, json.TOTPCode, json.RecoveryCode, accountKey, ipKey) {
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		// bcrypt hashes, and hashes made with older parameters, are replaced
+		// now that the password is known.
+		if auth.NeedsRehash(user.Password) {
+			if err := rehashPassword(c, db, user, json.Password); err != nil {
+				log.Println(err)
+			}
+		}
+
+		response, err := startSession(c, db, keys, user, user.TOTPEnabledAt != nil)
 		if err != nil {
+			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		c.JSON(http.StatusOK, response)
 	})
 
 	r.POST("/users", func(c *gin.Context) {
@@ -472,6 +734,27 @@ func main() {
 			return
 		}
 
+		if !checkPasswordPolicy(c, json.Password, json.Email, json.FirstName, json.LastName) {
+			return
+		}
+
+		if json.GiftCode != nil && *json.GiftCode == "" {
+			json.GiftCode = nil
+		}
+
+		if json.GiftCode != nil {
+			if err := checkGiftCode(c, db, *json.GiftCode); err != nil {
+				if status, response, ok := giftErrorResponse(err); ok {
+					c.JSON(status, response)
+					return
+				}
+
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
 		passwordHash, err := auth.HashPassword(json.Password)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
@@ -490,23 +773,27 @@ func main() {
 		}
 
 		token := auth.NewConfirmToken()
+		tokenHash := auth.HashCode(key, token)
+		tokenExpiresAt := time.Now().Add(auth.ConfirmTokenDuration)
 
 		user := &User{
-			ConfirmToken:  &token,
-			Email:         json.Email,
-			Password:      passwordHash,
-			PhoneNumber:   json.PhoneNumber,
-			FirstName:     json.FirstName,
-			LastName:      json.LastName,
-			Address:       json.Address,
-			PostalCode:    json.PostalCode,
-			City:          json.City,
-			Country:       json.Country,
-			Category:      json.Category,
-			Reason:        json.Reason,
-			Customer:      stripeCustomer.ID,
-			Accepted:      false,
-			InitialShares: 0,
+			ConfirmToken:          &tokenHash,
+			ConfirmTokenExpiresAt: &tokenExpiresAt,
+			Email:                 json.Email,
+			Password:              passwordHash,
+			PhoneNumber:           json.PhoneNumber,
+			FirstName:             json.FirstName,
+			LastName:              json.LastName,
+			Address:               json.Address,
+			PostalCode:            json.PostalCode,
+			City:                  json.City,
+			Country:               json.Country,
+			Category:              json.Category,
+			Reason:                json.Reason,
+			Customer:              stripeCustomer.ID,
+			Accepted:              false,
+			InitialShares:         0,
+			PendingGiftCode:       json.GiftCode,
 		}
 
 		_, err = db.NewInsert().Model(user).Exec(c)
@@ -532,9 +819,18 @@ func main() {
 			return
 		}
 
+		ipKey := ipThrottleKey(c)
+		if !checkThrottle(c, db, ipKey) {
+			return
+		}
+
 		user := new(User)
 		if err := db.NewSelect().Model(user).Where("email = ?", json.Email).Scan(c); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+					log.Println(err)
+				}
+
 				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this email address.", "email-unknown"})
 				return
 			}
@@ -544,25 +840,41 @@ func main() {
 			return
 		}
 
-		if user.ConfirmToken == nil || json.Token != *user.ConfirmToken {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{"This token is invalid.", "bad-token"})
+		accountKey := accountThrottleKey("confirm", user.ID)
+		if !checkThrottle(c, db, accountKey) {
 			return
 		}
 
-		update := &User{ID: user.ID, Confirmed: true, ConfirmToken: nil}
-		_, err = db.NewUpdate().Model(update).Column("confirmed", "confirm_token").WherePK().Exec(c)
-		if err != nil {
+		if user.ConfirmToken == nil || !auth.CheckCode(key, json.Token, *user.ConfirmToken) {
+			failFlowCode(c, db, user, "confirm_token", accountKey, ipKey)
+			return
+		}
+
+		if user.ConfirmTokenExpiresAt != nil && user.ConfirmTokenExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This token has expired.", "token-expired"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		if err := confirmAccount(c, db, user); err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
 		}
 
-		token, err := auth.NewToken(key, user.ID, user.Admin)
+		response, err := startSession(c, db, keys, user, false)
 		if err != nil {
+			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		claimPendingGift(c, db, mg, user, response)
+
+		c.JSON(http.StatusOK, response)
 	})
 
 	r.POST("/users/confirm/start", func(c *gin.Context) {
@@ -590,9 +902,11 @@ func main() {
 		}
 
 		token := auth.NewConfirmToken()
+		tokenHash := auth.HashCode(key, token)
+		tokenExpiresAt := time.Now().Add(auth.ConfirmTokenDuration)
 
-		update := &User{ID: user.ID, ConfirmToken: &token}
-		_, err = db.NewUpdate().Model(update).Column("confirm_token").WherePK().Exec(c)
+		update := &User{ID: user.ID, ConfirmToken: &tokenHash, ConfirmTokenExpiresAt: &tokenExpiresAt}
+		_, err = db.NewUpdate().Model(update).Column("confirm_token", "confirm_token_expires_at").WherePK().Exec(c)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
@@ -614,9 +928,18 @@ func main() {
 			return
 		}
 
+		ipKey := ipThrottleKey(c)
+		if !checkThrottle(c, db, ipKey) {
+			return
+		}
+
 		user := new(User)
 		if err := db.NewSelect().Model(user).Where("email = ?", json.Email).Scan(c); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
+				if _, err := recordFailedAttempt(c, db, ipKey); err != nil {
+					log.Println(err)
+				}
+
 				c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this email address.", "email-unknown"})
 				return
 			}
@@ -626,8 +949,32 @@ func main() {
 			return
 		}
 
-		if user.ResetToken == nil || json.Token != *user.ResetToken {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{"This token is invalid.", "bad-token"})
+		accountKey := accountThrottleKey("reset", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if user.ResetToken == nil || !auth.CheckCode(key, json.Token, *user.ResetToken) {
+			failFlowCode(c, db, user, "reset_token", accountKey, ipKey)
+			return
+		}
+
+		if user.ResetTokenExpiresAt != nil && user.ResetTokenExpiresAt.Before(time.Now()) {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{"This token has expired.", "token-expired"})
+			return
+		}
+
+		// The reset code only proves access to the mailbox: it must not be
+		// enough to get past two-factor authentication.
+		if !checkSecondFactor(c, db, key, user, json.TOTPCode, json.RecoveryCode, accountKey, ipKey) {
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		if !checkPasswordPolicy(c, json.Password, user.Email, user.FirstName, user.LastName) {
 			return
 		}
 
@@ -637,20 +984,48 @@ func main() {
 			return
 		}
 
-		update := &User{ID: user.ID, Confirmed: true, ResetToken: nil, ConfirmToken: nil, Password: passwordHash}
-		_, err = db.NewUpdate().Model(update).Column("confirmed", "reset_token", "confirm_token", "password").WherePK().Exec(c)
+		update := &User{ID: user.ID, ResetToken: nil, ResetTokenExpiresAt: nil, Password: passwordHash}
+		_, err = db.NewUpdate().Model(update).Column("reset_token", "reset_token_expires_at", "password").WherePK().Exec(c)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// The reset code proves access to the mailbox, which confirms the
+		// account like the confirmation code does.
+		wasConfirmed := user.Confirmed
+		if !wasConfirmed {
+			if err := confirmAccount(c, db, user); err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
+		if err := writeAudit(c, db, user.ID, c.ClientIP(), "password.reset", "user", user.ID, nil); err != nil {
+			log.Println(err)
+		}
+
+		// Whoever knew the old password must not stay logged in.
+		if err := revokeSessions(c, db, user.ID); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
 		}
 
-		token, err := auth.NewToken(key, user.ID, user.Admin)
+		response, err := startSession(c, db, keys, user, user.TOTPEnabledAt != nil)
 		if err != nil {
+			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"token": token})
+		if !wasConfirmed {
+			claimPendingGift(c, db, mg, user, response)
+		}
+
+		c.JSON(http.StatusOK, response)
 	})
 
 	r.POST("/users/reset/start", func(c *gin.Context) {
@@ -673,9 +1048,11 @@ func main() {
 		}
 
 		token := auth.NewResetToken()
+		tokenHash := auth.HashCode(key, token)
+		tokenExpiresAt := time.Now().Add(auth.ResetTokenDuration)
 
-		update := &User{ID: user.ID, ResetToken: &token}
-		_, err = db.NewUpdate().Model(update).Column("reset_token").WherePK().Exec(c)
+		update := &User{ID: user.ID, ResetToken: &tokenHash, ResetTokenExpiresAt: &tokenExpiresAt}
+		_, err = db.NewUpdate().Model(update).Column("reset_token", "reset_token_expires_at").WherePK().Exec(c)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
@@ -690,9 +1067,44 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{})
 	})
 
+	// A gift card can be fetched by its buyer, with their token, or by anyone
+	// holding a link signed by the buyer. The code is hidden once claimed.
 	r.GET("/gifts/:giftID", func(c *gin.Context) {
 		giftID := c.Param("giftID")
 
+		var claims *auth.CustomClaims
+		if signature := c.Query("signature"); signature != "" {
+			expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+			if err != nil || !auth.CheckSignature(key, giftCardResource(giftID), expires, signature) {
+				c.JSON(http.StatusForbidden, ErrorResponse{"This link is invalid or has expired.", "signature-invalid"})
+				return
+			}
+		} else {
+			token := auth.RequestToken(c)
+			if token == "" {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"The Authorization header or the token query is required for this route.", "authorization-header-missing"})
+				return
+			}
+
+			var err error
+			claims, err = auth.ParseToken(keys, token)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"The token is invalid.", "token-invalid"})
+				return
+			}
+
+			if err := auth.CheckSession(c, validateSession, claims); err != nil {
+				if errors.Is(err, auth.ErrSessionRevoked) {
+					c.JSON(http.StatusBadRequest, ErrorResponse{"The session has been revoked.", "session-revoked"})
+					return
+				}
+
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
 		gift := new(Gift)
 		if err := db.NewSelect().Model(gift).Where("gift.id = ?", giftID).Relation("Payment").Relation("Payment.User").Scan(c); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
@@ -705,21 +1117,86 @@ func main() {
 			return
 		}
 
-		image := generateGiftCard(gift.Payment.User.FirstName, gift.Code, gift.Payment.Shares)
+		if gift.Status == GiftStatusPending {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This gift has not been paid yet.", "gift-not-paid"})
+			return
+		}
+
+		if gift.Status != GiftStatusPaid && gift.Status != GiftStatusClaimed {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"})
+			return
+		}
+
+		if claims != nil && !claims.HasPermission(auth.PermissionRecordPayments) && (gift.BuyerUserID == nil || *gift.BuyerUserID != claims.UserID) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"})
+			return
+		}
 
-		c.Header("Content-Type", "image/png")
-		c.Header("Content-Disposition", `attachment; filename="cadeau.png"`)
+		card := *gift
+		if gift.Status == GiftStatusClaimed && (claims == nil || !claims.HasPermission(auth.PermissionRecordPayments)) {
+			card.Code = ""
+		}
 
-		if err := png.Encode(c.Writer, image); err != nil {
+		image, language, err := renderGiftCard(giftCardTemplates, &card, gift.Payment.User.FirstName)
+		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
+		fileName := "cadeau"
+		if language == LanguageEnglish {
+			fileName = "gift"
+		}
+
+		if c.Query("format") == "pdf" {
+			c.Header("Content-Type", "application/pdf")
+			c.Header("Content-Disposition", `attachment; filename="`+fileName+`.pdf"`)
+
+			if err := writeGiftCardPDF(c.Writer, image); err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		} else {
+			c.Header("Content-Type", "image/png")
+			c.Header("Content-Disposition", `attachment; filename="`+fileName+`.png"`)
+
+			if err := png.Encode(c.Writer, image); err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
 		c.Status(http.StatusOK)
 	})
 
-	authorized := r.Group("/", auth.Middleware(key))
+	r.GET("/gift-templates", func(c *gin.Context) {
+		templates := make([]GiftTemplateResponseItem, 0, len(giftCardTemplates))
+		for _, template := range giftCardTemplates {
+			templates = append(templates, GiftTemplateResponseItem{
+				ID:        template.ID,
+				Names:     template.Names,
+				Languages: template.Languages(),
+			})
+		}
+
+		sort.Slice(templates, func(i, j int) bool {
+			return templates[i].ID < templates[j].ID
+		})
+
+		c.JSON(http.StatusOK, templates)
+	})
+
+	authorized := r.Group("/", auth.Middleware(keys, validateSession, apiKeyValidator(db)), auth.ImpersonationMiddleware())
+
+	registerSessionRoutes(r, authorized, db, keys)
+	registerTOTPRoutes(authorized, db, key)
+	registerPasskeyRoutes(r, authorized, db, wa, key)
+	registerLoginLinkRoutes(r, db, mg, key, keys, appBaseURL)
+	registerEmailChangeRoutes(authorized, db, mg, key)
+	registerPasswordRoutes(r)
 
 	authorized.POST("/users/me/use-gift-code", func(c *gin.Context) {
 		var json UseGiftCodeRequest
@@ -728,12 +1205,12 @@ func main() {
 			return
 		}
 
-		log.Println(json)
+		userID := c.GetString("userID")
 
-		gift := new(Gift)
-		if err := db.NewSelect().Model(gift).Where("code = ?", json.GiftCode).Scan(c); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				c.JSON(http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"})
+		gift, err := claimGift(c, db, json.GiftCode, userID)
+		if err != nil {
+			if status, response, ok := giftErrorResponse(err); ok {
+				c.JSON(status, response)
 				return
 			}
 
@@ -742,19 +1219,48 @@ func main() {
 			return
 		}
 
-		if gift.ClaimedByUserID != nil {
-			c.JSON(http.StatusBadRequest, ErrorResponse{"Gift Code already claimed.", "gift-code-claimed"})
+		go notifyGiftClaimed(context.Background(), db, mg, gift)
+
+		c.JSON(http.StatusOK, gin.H{"shares": gift.Shares})
+	})
+
+	authorized.POST("/users/me/gifts/:giftID/links", func(c *gin.Context) {
+		var json CreateGiftLinkRequest
+		if err := c.ShouldBindJSON(&json); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
 			return
 		}
 
 		userID := c.GetString("userID")
-		giftUpdate := &Gift{ID: gift.ID, ClaimedByUserID: &userID}
-		_, err = db.NewUpdate().Model(giftUpdate).Column("claimed_by_user_id").WherePK().Exec(c)
+		giftID := c.Param("giftID")
+
+		exists, err := db.NewSelect().Table("gifts").Where("id = ?", giftID).Where("buyer_user_id = ?", userID).Where("status IN (?)", bun.In([]string{GiftStatusPaid, GiftStatusClaimed})).Exists(c)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
+		if !exists {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Gift not found.", "not-found"})
+			return
+		}
+
+		days := json.Days
+		if days == 0 {
+			days = defaultGiftLinkDays
+		}
+
+		expires := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+		signature := auth.Sign(key, giftCardResource(giftID), expires)
+
+		query := url.Values{}
+		query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+		query.Set("signature", signature)
+
+		c.JSON(http.StatusOK, gin.H{
+			"url":       apiBaseURL + "gifts/" + giftID + "?" + query.Encode(),
+			"expiresAt": expires,
+		})
 	})
 
 	authorized.GET("/users/me", func(c *gin.Context) {
@@ -768,22 +1274,37 @@ func main() {
 			return
 		}
 
-		var shares uint
-		err = db.NewSelect().Table("payments").Join("LEFT JOIN gifts").JoinOn("gifts.id = payments.gift_id").ColumnExpr("COALESCE(SUM(shares), 0)").Where("payments.user_id = ?", userID).WhereOr("gifts.claimed_by_user_id = ?", userID).Scan(c, &shares)
+		shares, err := userShares(c, db, user)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
-		shares += user.InitialShares
+		var giftedShares int
+		err = db.NewSelect().Table("share_movements").ColumnExpr("COALESCE(SUM(shares), 0)").Where("user_id = ?", userID).Where("kind = ?", ShareMovementGiftReceived).Scan(c, &giftedShares)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
 
 		mustUploadDocuments := user.IdentityFront == nil || user.AddressProof == nil
 
+		var missingShares uint
+		if shares < minimumShares {
+			missingShares = minimumShares - shares
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"email":               user.Email,
+			"newEmail":            user.NewEmail,
 			"mustUploadDocuments": mustUploadDocuments,
 			"shares":              shares,
+			"giftedShares":        giftedShares,
+			"minimumShares":       minimumShares,
+			"missingShares":       missingShares,
+			"profile":             profileResponse(user),
 		})
 	})
 
@@ -836,6 +1357,10 @@ func main() {
 			return
 		}
 
+		if err := writeAudit(c, db, userID, c.ClientIP(), "documents.upload", "user", userID, nil); err != nil {
+			log.Println(err)
+		}
+
 		c.JSON(http.StatusOK, gin.H{})
 	})
 
@@ -874,11 +1399,88 @@ func main() {
 			},
 		}
 
+		campaign, err := activeCampaign(c, db)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if campaign != nil {
+			if campaign.Cap != nil {
+				raised, err := campaignRaised(c, db, campaign.ID)
+				if err != nil {
+					log.Println(err)
+					c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+					return
+				}
+
+				price, err := sharePrice.get()
+				if err != nil {
+					log.Println(err)
+					c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+					return
+				}
+
+				// Only the paid shares are counted: the checkouts still in
+				// progress can take the campaign past its cap, and their
+				// payments are accepted. They expire quickly to keep that
+				// window short.
+				if raised+json.Quantity*price > *campaign.Cap {
+					c.JSON(http.StatusBadRequest, ErrorResponse{"The capital cap of the current campaign has been reached.", "campaign-cap-reached"})
+					return
+				}
+
+				params.ExpiresAt = stripe.Int64(time.Now().Add(capCheckoutDuration).Unix())
+			}
+
+			params.Params.Metadata["campaignID"] = campaign.ID
+		}
+
 		log.Println(json)
 
+		var gift *Gift
 		if json.Gift {
-			gift := &Gift{
-				Code: gofakeit.Regex("[ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789]{8}"),
+			if json.GiftTemplate == "" {
+				json.GiftTemplate = defaultGiftCardTemplate
+			}
+			if json.GiftLanguage == "" {
+				json.GiftLanguage = LanguageFrench
+			}
+
+			template, ok := giftCardTemplates[json.GiftTemplate]
+			if !ok {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"This gift card template does not exist.", "gift-template-unknown"})
+				return
+			}
+			if !template.Supports(json.GiftLanguage) {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"This gift card template is not available in this language.", "gift-language-unsupported"})
+				return
+			}
+
+			gift = &Gift{
+				Code:        newGiftCode(),
+				Status:      GiftStatusPending,
+				BuyerUserID: &userID,
+				Shares:      json.Quantity,
+				Template:    json.GiftTemplate,
+				Language:    json.GiftLanguage,
+				Message:     json.Message,
+			}
+
+			if json.RecipientEmail != nil {
+				deliverAt := time.Now()
+				if json.DeliveryDate != nil {
+					deliverAt, err = parseGiftDeliveryDate(*json.DeliveryDate)
+					if err != nil {
+						c.JSON(http.StatusBadRequest, ErrorResponse{"The delivery date cannot be in the past.", "delivery-date-invalid"})
+						return
+					}
+				}
+
+				gift.RecipientName = json.RecipientName
+				gift.RecipientEmail = json.RecipientEmail
+				gift.DeliverAt = &deliverAt
 			}
 			_, err := db.NewInsert().Model(gift).Returning("id").Exec(c)
 			if err != nil {
@@ -898,16 +1500,31 @@ func main() {
 			return
 		}
 
+		if gift != nil {
+			giftUpdate := &Gift{ID: gift.ID, CheckoutSessionID: &s.ID}
+			_, err = db.NewUpdate().Model(giftUpdate).Column("checkout_session_id").WherePK().Exec(c)
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"url": s.URL,
 		})
 	})
 
-	admin := authorized.Group("/admin", auth.AdminMiddleware())
+	admin := authorized.Group("/admin", auth.AdminMiddleware(), auditReads(db))
+	members := admin.Group("", auth.PermissionMiddleware(auth.PermissionViewMembers))
+	documents := admin.Group("", auth.PermissionMiddleware(auth.PermissionViewDocuments))
+	payments := admin.Group("", auth.PermissionMiddleware(auth.PermissionRecordPayments))
+	editors := admin.Group("", auth.PermissionMiddleware(auth.PermissionEditMembers))
+	admins := admin.Group("", auth.PermissionMiddleware(auth.PermissionManageAdmins))
 
-	admin.GET("/csv/users", func(c *gin.Context) {
+	members.GET("/csv/users", func(c *gin.Context) {
 		users := make([]AdminCSVGetUsersItem, 0)
-		if err := db.NewRaw("SELECT u.id, u.confirmed, u.accepted, u.email, u.phone_number, u.first_name, u.last_name, u.address, u.postal_code, u.city, u.country, u.category, u.reason, COALESCE(SUM(p.shares), 0) + u.initial_shares AS shares FROM users AS u LEFT JOIN payments AS p ON u.id = p.user_id GROUP BY u.id, u.confirmed, u.accepted, u.email, u.phone_number, u.first_name, u.last_name, u.address, u.postal_code, u.city, u.country, u.category, u.reason ORDER BY u.email ASC").Scan(c, &users); err != nil {
+		if err := db.NewRaw("SELECT u.id, u.confirmed, u.accepted, u.email, u.phone_number, u.first_name, u.last_name, u.address, u.postal_code, u.city, u.country, u.category, u.reason, ? AS shares FROM users AS u ORDER BY u.email ASC", bun.Safe(userSharesSQL)).Scan(c, &users); err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
@@ -935,9 +1552,9 @@ func main() {
 		return
 	})
 
-	admin.GET("/users", func(c *gin.Context) {
+	members.GET("/users", func(c *gin.Context) {
 		users := make([]AdminGetUsersResponseItem, 0)
-		if err := db.NewRaw("SELECT u.id, u.email, u.first_name, u.last_name, u.accepted, u.category, COALESCE(SUM(p.shares), 0) + u.initial_shares AS shares FROM users AS u LEFT JOIN payments AS p ON u.id = p.user_id GROUP BY u.id, u.email, u.first_name, u.last_name, u.accepted, u.category ORDER BY u.email ASC").Scan(c, &users); err != nil {
+		if err := db.NewRaw("SELECT u.id, u.email, u.first_name, u.last_name, u.accepted, u.category, ? AS shares FROM users AS u ORDER BY u.email ASC", bun.Safe(userSharesSQL)).Scan(c, &users); err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
@@ -947,7 +1564,7 @@ func main() {
 		return
 	})
 
-	admin.GET("/users/:userID", func(c *gin.Context) {
+	members.GET("/users/:userID", func(c *gin.Context) {
 		userID := c.Param("userID")
 
 		user := new(User)
@@ -962,41 +1579,46 @@ func main() {
 			return
 		}
 
-		var shares uint
-		err = db.NewSelect().Table("payments").ColumnExpr("COALESCE(SUM(shares), 0)").Where("user_id = ?", userID).Scan(c, &shares)
+		shares, err := userShares(c, db, user)
 		if err != nil {
 			log.Println(err)
 			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
 			return
 		}
 
-		shares += user.InitialShares
-
 		response := &AdminGetUserResponse{
-			ID:            user.ID,
-			Confirmed:     user.Confirmed,
-			Admin:         user.Admin,
-			Email:         user.Email,
-			PhoneNumber:   user.PhoneNumber,
-			FirstName:     user.FirstName,
-			LastName:      user.LastName,
-			Address:       user.Address,
-			PostalCode:    user.PostalCode,
-			City:          user.City,
-			Country:       user.Country,
-			Category:      user.Category,
-			Reason:        user.Reason,
-			IdentityFront: user.IdentityFront,
-			IdentityBack:  user.IdentityBack,
-			AddressProof:  user.AddressProof,
-			Shares:        shares,
+			ID:                 user.ID,
+			Confirmed:          user.Confirmed,
+			Roles:              user.Roles,
+			Email:              user.Email,
+			PhoneNumber:        user.PhoneNumber,
+			FirstName:          user.FirstName,
+			LastName:           user.LastName,
+			Address:            user.Address,
+			PostalCode:         user.PostalCode,
+			City:               user.City,
+			Country:            user.Country,
+			Category:           user.Category,
+			Reason:             user.Reason,
+			IdentityFront:      user.IdentityFront,
+			IdentityBack:       user.IdentityBack,
+			AddressProof:       user.AddressProof,
+			Shares:             shares,
+			ErasureRequestedAt: user.ErasureRequestedAt,
+			ErasedAt:           user.ErasedAt,
+		}
+
+		if !auth.HasPermission(c, auth.PermissionViewDocuments) {
+			response.IdentityFront = nil
+			response.IdentityBack = nil
+			response.AddressProof = nil
 		}
 
 		c.JSON(http.StatusOK, response)
 		return
 	})
 
-	admin.GET("/users/:userID/documents/:documentID", func(c *gin.Context) {
+	documents.GET("/users/:userID/documents/:documentID", func(c *gin.Context) {
 		userID := c.Param("userID")
 		documentID := c.Param("documentID")
 
@@ -1005,6 +1627,19 @@ func main() {
 		c.File(documentPath)
 	})
 
+	registerCampaignRoutes(r, payments, db)
+	registerGiftAdminRoutes(payments, db, mg, giftCardTemplates, appBaseURL)
+	// The issuer has no trailing slash, as the clients append the paths of
+	// the discovery document to it.
+	registerOIDCRoutes(r, authorized, admins, db, keys, strings.TrimSuffix(apiBaseURL, "/"), appBaseURL)
+	registerRoleRoutes(admins, db)
+	registerImpersonationRoutes(members, db, keys)
+	registerAPIKeyRoutes(admins, db)
+	registerProfileRoutes(authorized, members, db)
+	registerDataExportRoutes(authorized, db, dataPath, dataExportRequested)
+	registerErasureRoutes(authorized, editors, db, dataPath)
+	registerAuditRoutes(admins, db)
+
 	r.POST("/stripe/webhook", func(c *gin.Context) {
 		const MaxBodyBytes = int64(65536)
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxBodyBytes)
@@ -1030,6 +1665,7 @@ func main() {
 
 			userID := session.Metadata["userID"]
 			giftID := session.Metadata["giftID"]
+			campaignID := session.Metadata["campaignID"]
 
 			shares, err := strconv.Atoi(session.Metadata["shares"])
 			if err != nil {
@@ -1049,12 +1685,55 @@ func main() {
 				log.Println("giftID is not empty")
 				payment.GiftID = &giftID
 			}
-			_, err = db.NewInsert().Model(payment).Exec(c)
+			if campaignID != "" {
+				payment.CampaignID = &campaignID
+			}
+
+			err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.NewInsert().Model(payment).Exec(ctx); err != nil {
+					return err
+				}
+
+				if payment.GiftID == nil {
+					return nil
+				}
+
+				gift := &Gift{ID: giftID, Status: GiftStatusPaid, PaidAt: &payment.CreatedAt}
+				columns := []string{"status", "paid_at"}
+				if giftValidity != 0 {
+					expiresAt := payment.CreatedAt.Add(giftValidity)
+					gift.ExpiresAt = &expiresAt
+					columns = append(columns, "expires_at")
+				}
+
+				// A gift cancelled by the clean-up job can still be paid if
+				// the customer took their time, but not one revoked by an
+				// admin.
+				_, err := tx.NewUpdate().Model(gift).Column(columns...).WherePK().Where("status IN (?)", bun.In([]string{GiftStatusPending, GiftStatusCancelled})).Exec(ctx)
+				return err
+			})
 			if err != nil {
 				log.Println(err)
 				c.JSON(http.StatusInternalServerError, gin.H{})
 				return
 			}
+		} else if event.Type == "checkout.session.expired" {
+			var session stripe.CheckoutSession
+			err := json.Unmarshal(event.Data.Raw, &session)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{})
+				return
+			}
+
+			if giftID := session.Metadata["giftID"]; giftID != "" {
+				gift := &Gift{ID: giftID, Status: GiftStatusCancelled}
+				_, err = db.NewUpdate().Model(gift).Column("status").WherePK().Where("status = ?", GiftStatusPending).Exec(c)
+				if err != nil {
+					log.Println(err)
+					c.JSON(http.StatusInternalServerError, gin.H{})
+					return
+				}
+			}
 		}
 
 		c.JSON(http.StatusOK, gin.H{})
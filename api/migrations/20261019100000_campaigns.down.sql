@@ -0,0 +1,9 @@
+ALTER TABLE payments DROP CONSTRAINT payments_campaign_id_foreign_key;
+
+--bun:split
+
+ALTER TABLE payments DROP COLUMN campaign_id;
+
+--bun:split
+
+DROP TABLE campaigns;
@@ -0,0 +1,20 @@
+CREATE TABLE campaigns (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  name TEXT NOT NULL,
+  goal INTEGER NOT NULL,
+  cap INTEGER,
+  starts_at TIMESTAMPTZ NOT NULL,
+  ends_at TIMESTAMPTZ NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT campaigns_primary_key PRIMARY KEY (id),
+  CONSTRAINT campaigns_dates_check CHECK (starts_at < ends_at)
+);
+
+--bun:split
+
+ALTER TABLE payments ADD COLUMN campaign_id UUID;
+
+--bun:split
+
+ALTER TABLE payments ADD CONSTRAINT payments_campaign_id_foreign_key FOREIGN KEY (campaign_id) REFERENCES campaigns (id);
@@ -0,0 +1,33 @@
+ALTER TABLE gifts DROP CONSTRAINT gifts_status_check;
+
+--bun:split
+
+ALTER TABLE gifts DROP CONSTRAINT gifts_buyer_user_id_foreign_key;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN expires_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN paid_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN created_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN checkout_session_id;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN shares;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN buyer_user_id;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN status;
@@ -0,0 +1,41 @@
+ALTER TABLE gifts ADD COLUMN status TEXT NOT NULL DEFAULT 'pending';
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN buyer_user_id UUID;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN shares INTEGER NOT NULL DEFAULT 0;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN checkout_session_id TEXT;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN paid_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN expires_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE gifts ADD CONSTRAINT gifts_buyer_user_id_foreign_key FOREIGN KEY (buyer_user_id) REFERENCES users (id);
+
+--bun:split
+
+ALTER TABLE gifts ADD CONSTRAINT gifts_status_check CHECK (status IN ('pending', 'paid', 'claimed', 'expired', 'cancelled'));
+
+--bun:split
+
+UPDATE gifts SET buyer_user_id = payments.user_id, shares = payments.shares, paid_at = payments.created_at, status = CASE WHEN gifts.claimed_by_user_id IS NULL THEN 'paid' ELSE 'claimed' END FROM payments WHERE payments.gift_id = gifts.id;
+
+--bun:split
+
+UPDATE gifts SET status = 'cancelled' WHERE status = 'pending';
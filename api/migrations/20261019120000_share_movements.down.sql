@@ -0,0 +1,5 @@
+ALTER TABLE gifts DROP COLUMN claimed_at;
+
+--bun:split
+
+DROP TABLE share_movements;
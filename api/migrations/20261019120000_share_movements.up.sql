@@ -0,0 +1,32 @@
+CREATE TABLE share_movements (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  shares INTEGER NOT NULL,
+  kind TEXT NOT NULL,
+  gift_id TEXT,
+  counterpart_user_id UUID,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT share_movements_primary_key PRIMARY KEY (id),
+  CONSTRAINT share_movements_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id),
+  CONSTRAINT share_movements_gift_id_foreign_key FOREIGN KEY (gift_id) REFERENCES gifts (id),
+  CONSTRAINT share_movements_counterpart_user_id_foreign_key FOREIGN KEY (counterpart_user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX share_movements_user_id_index ON share_movements (user_id);
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN claimed_at TIMESTAMPTZ;
+
+--bun:split
+
+INSERT INTO share_movements (user_id, shares, kind, gift_id, counterpart_user_id, created_at)
+SELECT buyer_user_id, -shares, 'gift-sent', id, claimed_by_user_id, COALESCE(paid_at, CURRENT_TIMESTAMP) FROM gifts WHERE status = 'claimed';
+
+--bun:split
+
+INSERT INTO share_movements (user_id, shares, kind, gift_id, counterpart_user_id, created_at)
+SELECT claimed_by_user_id, shares, 'gift-received', id, buyer_user_id, COALESCE(paid_at, CURRENT_TIMESTAMP) FROM gifts WHERE status = 'claimed';
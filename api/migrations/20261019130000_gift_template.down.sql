@@ -0,0 +1,5 @@
+ALTER TABLE gifts DROP COLUMN language;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN template;
@@ -0,0 +1,5 @@
+ALTER TABLE gifts ADD COLUMN template TEXT NOT NULL DEFAULT 'classic';
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN language TEXT NOT NULL DEFAULT 'fr';
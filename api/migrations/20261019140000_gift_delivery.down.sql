@@ -0,0 +1,17 @@
+ALTER TABLE gifts DROP COLUMN delivered_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN deliver_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN message;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN recipient_email;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN recipient_name;
@@ -0,0 +1,17 @@
+ALTER TABLE gifts ADD COLUMN recipient_name TEXT;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN recipient_email TEXT;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN message TEXT;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN deliver_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN delivered_at TIMESTAMPTZ;
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN pending_gift_code TEXT;
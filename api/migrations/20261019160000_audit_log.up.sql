@@ -0,0 +1,16 @@
+CREATE TABLE audit_log (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  actor_user_id UUID,
+  action TEXT NOT NULL,
+  target_type TEXT NOT NULL,
+  target_id TEXT NOT NULL,
+  details JSONB NOT NULL DEFAULT '{}',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT audit_log_primary_key PRIMARY KEY (id),
+  CONSTRAINT audit_log_actor_user_id_foreign_key FOREIGN KEY (actor_user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX audit_log_target_index ON audit_log (target_type, target_id);
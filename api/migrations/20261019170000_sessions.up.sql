@@ -0,0 +1,24 @@
+CREATE TABLE sessions (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  refresh_token_hash TEXT NOT NULL,
+  previous_refresh_token_hash TEXT,
+  user_agent TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_used_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMPTZ NOT NULL,
+  revoked_at TIMESTAMPTZ,
+
+  CONSTRAINT sessions_primary_key PRIMARY KEY (id),
+  CONSTRAINT sessions_refresh_token_hash_unique UNIQUE (refresh_token_hash),
+  CONSTRAINT sessions_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX sessions_user_id_index ON sessions (user_id);
+
+--bun:split
+
+CREATE INDEX sessions_previous_refresh_token_hash_index ON sessions (previous_refresh_token_hash);
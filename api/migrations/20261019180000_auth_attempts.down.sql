@@ -0,0 +1,9 @@
+ALTER TABLE users DROP COLUMN reset_token_expires_at;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN confirm_token_expires_at;
+
+--bun:split
+
+DROP TABLE auth_attempts;
@@ -0,0 +1,21 @@
+CREATE TABLE auth_attempts (
+  key TEXT NOT NULL,
+  failures INTEGER NOT NULL,
+  locked_until TIMESTAMPTZ,
+  updated_at TIMESTAMPTZ NOT NULL,
+
+  CONSTRAINT auth_attempts_primary_key PRIMARY KEY (key)
+);
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN confirm_token_expires_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN reset_token_expires_at TIMESTAMPTZ;
+
+--bun:split
+
+-- Codes are now stored hashed: the ones pending in clear must be requested again.
+UPDATE users SET confirm_token = NULL, reset_token = NULL;
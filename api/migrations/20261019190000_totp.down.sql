@@ -0,0 +1,17 @@
+DROP TABLE recovery_codes;
+
+--bun:split
+
+ALTER TABLE sessions DROP COLUMN mfa;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN totp_last_step;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN totp_enabled_at;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN totp_secret;
@@ -0,0 +1,30 @@
+ALTER TABLE users ADD COLUMN totp_secret TEXT;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN totp_enabled_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN totp_last_step BIGINT;
+
+--bun:split
+
+ALTER TABLE sessions ADD COLUMN mfa BOOLEAN NOT NULL DEFAULT FALSE;
+
+--bun:split
+
+CREATE TABLE recovery_codes (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  code_hash TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  used_at TIMESTAMPTZ,
+
+  CONSTRAINT recovery_codes_primary_key PRIMARY KEY (id),
+  CONSTRAINT recovery_codes_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX recovery_codes_user_id_index ON recovery_codes (user_id);
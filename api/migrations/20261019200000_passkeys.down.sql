@@ -0,0 +1,5 @@
+DROP TABLE passkey_challenges;
+
+--bun:split
+
+DROP TABLE passkeys;
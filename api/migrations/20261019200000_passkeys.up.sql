@@ -0,0 +1,29 @@
+CREATE TABLE passkeys (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  credential_id BYTEA NOT NULL,
+  credential JSONB NOT NULL,
+  name TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_used_at TIMESTAMPTZ,
+
+  CONSTRAINT passkeys_primary_key PRIMARY KEY (id),
+  CONSTRAINT passkeys_credential_id_unique UNIQUE (credential_id),
+  CONSTRAINT passkeys_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX passkeys_user_id_index ON passkeys (user_id);
+
+--bun:split
+
+CREATE TABLE passkey_challenges (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID,
+  session JSONB NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+
+  CONSTRAINT passkey_challenges_primary_key PRIMARY KEY (id),
+  CONSTRAINT passkey_challenges_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
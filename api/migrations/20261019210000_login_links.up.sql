@@ -0,0 +1,10 @@
+CREATE TABLE login_links (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMPTZ NOT NULL,
+  used_at TIMESTAMPTZ,
+
+  CONSTRAINT login_links_primary_key PRIMARY KEY (id),
+  CONSTRAINT login_links_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,5 @@
+DROP TABLE oidc_codes;
+
+--bun:split
+
+DROP TABLE oidc_clients;
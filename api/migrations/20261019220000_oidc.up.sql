@@ -0,0 +1,27 @@
+CREATE TABLE oidc_clients (
+  id TEXT NOT NULL,
+  name TEXT NOT NULL,
+  secret_hash TEXT,
+  redirect_uris TEXT[] NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT oidc_clients_primary_key PRIMARY KEY (id)
+);
+
+--bun:split
+
+CREATE TABLE oidc_codes (
+  code_hash TEXT NOT NULL,
+  client_id TEXT NOT NULL,
+  user_id UUID NOT NULL,
+  redirect_uri TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  nonce TEXT,
+  code_challenge TEXT NOT NULL,
+  auth_time TIMESTAMPTZ NOT NULL,
+  expires_at TIMESTAMPTZ NOT NULL,
+
+  CONSTRAINT oidc_codes_primary_key PRIMARY KEY (code_hash),
+  CONSTRAINT oidc_codes_client_id_foreign_key FOREIGN KEY (client_id) REFERENCES oidc_clients (id) ON DELETE CASCADE,
+  CONSTRAINT oidc_codes_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
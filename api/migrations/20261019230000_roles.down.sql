@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN admin BOOLEAN NOT NULL DEFAULT FALSE;
+
+--bun:split
+
+UPDATE users SET admin = 'administrator' = ANY(roles);
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN roles;
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN roles TEXT[] NOT NULL DEFAULT '{}';
+
+--bun:split
+
+UPDATE users SET roles = '{administrator}' WHERE admin;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN admin;
@@ -0,0 +1,9 @@
+ALTER TABLE users DROP COLUMN email_change_token_expires_at;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN email_change_token;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN new_email;
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN new_email TEXT;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN email_change_token TEXT;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN email_change_token_expires_at TIMESTAMPTZ;
@@ -0,0 +1,5 @@
+ALTER TABLE sessions ADD COLUMN impersonator_user_id UUID;
+
+--bun:split
+
+ALTER TABLE sessions ADD CONSTRAINT sessions_impersonator_user_id_foreign_key FOREIGN KEY (impersonator_user_id) REFERENCES users (id);
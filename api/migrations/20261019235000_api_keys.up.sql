@@ -0,0 +1,16 @@
+CREATE TABLE api_keys (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  name TEXT NOT NULL,
+  key_hash TEXT NOT NULL,
+  prefix TEXT NOT NULL,
+  scopes TEXT[] NOT NULL,
+  created_by_user_id UUID NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at TIMESTAMPTZ,
+  revoked_at TIMESTAMPTZ,
+  last_used_at TIMESTAMPTZ,
+
+  CONSTRAINT api_keys_primary_key PRIMARY KEY (id),
+  CONSTRAINT api_keys_key_hash_unique UNIQUE (key_hash),
+  CONSTRAINT api_keys_created_by_user_id_foreign_key FOREIGN KEY (created_by_user_id) REFERENCES users (id)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE profile_changes (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  field TEXT NOT NULL,
+  previous_value TEXT NOT NULL,
+  new_value TEXT NOT NULL,
+  changed_by_user_id UUID,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT profile_changes_primary_key PRIMARY KEY (id),
+  CONSTRAINT profile_changes_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id),
+  CONSTRAINT profile_changes_changed_by_user_id_foreign_key FOREIGN KEY (changed_by_user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX profile_changes_user_id_index ON profile_changes (user_id, created_at);
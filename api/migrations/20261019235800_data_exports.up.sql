@@ -0,0 +1,15 @@
+CREATE TABLE data_exports (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  completed_at TIMESTAMPTZ,
+  expires_at TIMESTAMPTZ,
+
+  CONSTRAINT data_exports_primary_key PRIMARY KEY (id),
+  CONSTRAINT data_exports_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX data_exports_user_id_index ON data_exports (user_id, created_at);
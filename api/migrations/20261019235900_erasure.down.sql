@@ -0,0 +1,5 @@
+ALTER TABLE users DROP COLUMN erased_at;
+
+--bun:split
+
+ALTER TABLE users DROP COLUMN erasure_requested_at;
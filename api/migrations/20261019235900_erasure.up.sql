@@ -0,0 +1,5 @@
+ALTER TABLE users ADD COLUMN erasure_requested_at TIMESTAMPTZ;
+
+--bun:split
+
+ALTER TABLE users ADD COLUMN erased_at TIMESTAMPTZ;
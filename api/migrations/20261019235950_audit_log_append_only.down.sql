@@ -0,0 +1,21 @@
+DROP TRIGGER audit_log_append_only ON audit_log;
+
+--bun:split
+
+DROP FUNCTION audit_log_append_only;
+
+--bun:split
+
+DROP INDEX audit_log_action_index;
+
+--bun:split
+
+DROP INDEX audit_log_actor_user_id_index;
+
+--bun:split
+
+DROP INDEX audit_log_created_at_index;
+
+--bun:split
+
+ALTER TABLE audit_log DROP COLUMN ip;
@@ -0,0 +1,33 @@
+ALTER TABLE audit_log ADD COLUMN ip TEXT;
+
+--bun:split
+
+CREATE INDEX audit_log_created_at_index ON audit_log (created_at);
+
+--bun:split
+
+CREATE INDEX audit_log_actor_user_id_index ON audit_log (actor_user_id, created_at);
+
+--bun:split
+
+CREATE INDEX audit_log_action_index ON audit_log (action, created_at);
+
+--bun:split
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  IF current_setting('entrelac.audit_maintenance', true) IS DISTINCT FROM 'on' THEN
+    RAISE EXCEPTION 'audit_log is append-only';
+  END IF;
+
+  IF TG_OP = 'DELETE' THEN
+    RETURN OLD;
+  END IF;
+
+  RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+--bun:split
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
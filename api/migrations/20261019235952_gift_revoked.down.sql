@@ -0,0 +1,9 @@
+UPDATE gifts SET status = 'cancelled' WHERE status = 'revoked';
+
+--bun:split
+
+ALTER TABLE gifts DROP CONSTRAINT gifts_status_check;
+
+--bun:split
+
+ALTER TABLE gifts ADD CONSTRAINT gifts_status_check CHECK (status IN ('pending', 'paid', 'claimed', 'expired', 'cancelled'));
@@ -0,0 +1,19 @@
+ALTER TABLE gifts DROP CONSTRAINT gifts_status_check;
+
+--bun:split
+
+ALTER TABLE gifts ADD CONSTRAINT gifts_status_check CHECK (status IN ('pending', 'paid', 'claimed', 'expired', 'cancelled', 'revoked'));
+
+--bun:split
+
+UPDATE gifts SET status = 'revoked' WHERE status = 'cancelled' AND id::text IN (SELECT target_id FROM audit_log WHERE action = 'gift.revoke');
+
+--bun:split
+
+DO $$
+BEGIN
+  PERFORM set_config('entrelac.audit_maintenance', 'on', true);
+  UPDATE audit_log SET details = details - 'code' WHERE action = 'gift.revoke';
+  UPDATE audit_log SET details = details - 'oldCode' - 'newCode' WHERE action = 'gift.reissue';
+END;
+$$;
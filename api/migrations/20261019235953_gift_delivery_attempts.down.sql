@@ -0,0 +1,9 @@
+ALTER TABLE gifts DROP COLUMN delivery_retry_at;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN delivery_error;
+
+--bun:split
+
+ALTER TABLE gifts DROP COLUMN delivery_attempts;
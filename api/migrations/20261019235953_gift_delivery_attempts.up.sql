@@ -0,0 +1,9 @@
+ALTER TABLE gifts ADD COLUMN delivery_attempts INTEGER NOT NULL DEFAULT 0;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN delivery_error TEXT;
+
+--bun:split
+
+ALTER TABLE gifts ADD COLUMN delivery_retry_at TIMESTAMPTZ;
@@ -0,0 +1,23 @@
+CREATE TABLE oidc_consents (
+  id UUID NOT NULL DEFAULT gen_random_uuid(),
+  user_id UUID NOT NULL,
+  client_id TEXT NOT NULL,
+  client_name TEXT NOT NULL,
+  scope TEXT NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  CONSTRAINT oidc_consents_primary_key PRIMARY KEY (id),
+  CONSTRAINT oidc_consents_user_id_foreign_key FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+--bun:split
+
+CREATE INDEX oidc_consents_user_id_index ON oidc_consents (user_id, created_at);
+
+--bun:split
+
+INSERT INTO oidc_consents (user_id, client_id, client_name, scope, created_at)
+SELECT a.target_id::uuid, a.details->>'clientId', COALESCE(c.name, a.details->>'clientId'), COALESCE(a.details->>'scope', ''), a.created_at
+FROM audit_log AS a
+LEFT JOIN oidc_clients AS c ON c.id = a.details->>'clientId'
+WHERE a.action = 'oauth.authorize' AND a.target_type = 'user' AND a.details ? 'clientId';
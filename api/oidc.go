@@ -0,0 +1,671 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// The other tools of the cooperative log their users in with our accounts,
+// following OpenID Connect: the authorization code flow, with PKCE.
+const (
+	oidcCodeDuration        = time.Minute
+	oidcAccessTokenDuration = time.Hour
+	oidcIDTokenDuration     = time.Hour
+)
+
+const (
+	OIDCScopeOpenID     = "openid"
+	OIDCScopeProfile    = "profile"
+	OIDCScopeEmail      = "email"
+	OIDCScopeMembership = "membership"
+)
+
+var oidcScopes = []string{OIDCScopeOpenID, OIDCScopeProfile, OIDCScopeEmail, OIDCScopeMembership}
+
+// The status of a member, as seen by the other tools.
+const (
+	// MemberStatusRegistered is an account which does not hold enough shares.
+	MemberStatusRegistered = "registered"
+	// MemberStatusPending is an account holding enough shares, whose
+	// membership was not accepted yet.
+	MemberStatusPending = "pending"
+	MemberStatusMember  = "member"
+)
+
+type OIDCClient struct {
+	bun.BaseModel `bun:"table:oidc_clients"`
+
+	ID           string    `bun:"id,pk"`
+	Name         string    `bun:"name,notnull"`
+	SecretHash   *string   `bun:"secret_hash"`
+	RedirectURIs []string  `bun:"redirect_uris,array,notnull"`
+	CreatedAt    time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+type OIDCCode struct {
+	bun.BaseModel `bun:"table:oidc_codes"`
+
+	CodeHash      string    `bun:"code_hash,pk"`
+	ClientID      string    `bun:"client_id,notnull"`
+	UserID        string    `bun:"user_id,notnull"`
+	RedirectURI   string    `bun:"redirect_uri,notnull"`
+	Scope         string    `bun:"scope,notnull"`
+	Nonce         *string   `bun:"nonce"`
+	CodeChallenge string    `bun:"code_challenge,notnull"`
+	AuthTime      time.Time `bun:"auth_time,notnull"`
+	ExpiresAt     time.Time `bun:"expires_at,notnull"`
+}
+
+// OIDCConsent records the consent of a member to share their data with a
+// client. It is kept apart from the audit log, which is purged, as members
+// can ask for their history.
+type OIDCConsent struct {
+	bun.BaseModel `bun:"table:oidc_consents"`
+
+	ID         string    `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID     string    `bun:"user_id,notnull"`
+	ClientID   string    `bun:"client_id,notnull"`
+	ClientName string    `bun:"client_name,notnull"`
+	Scope      string    `bun:"scope,notnull"`
+	CreatedAt  time.Time `bun:"created_at,notnull,default:current_timestamp"`
+}
+
+type OIDCClientRequest struct {
+	Name         string   `json:"name" binding:"required"`
+	RedirectURIs []string `json:"redirect_uris" binding:"required,min=1,dive,url"`
+	// Public clients, such as single page apps, cannot keep a secret: they
+	// only rely on PKCE.
+	Public bool `json:"public"`
+}
+
+type OIDCClientResponseItem struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Public       bool      `json:"public"`
+	CreatedAt    time.Time `json:"createdAt"`
+	// Secret is only returned when it is created.
+	Secret *string `json:"secret,omitempty"`
+}
+
+type OIDCAuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+}
+
+type OIDCAccessTokenClaims struct {
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	jwt.RegisteredClaims
+}
+
+var errOIDCClient = errors.New("unknown client or redirect URI")
+
+func newOIDCClientResponseItem(client *OIDCClient) *OIDCClientResponseItem {
+	return &OIDCClientResponseItem{
+		ID:           client.ID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Public:       client.SecretHash == nil,
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// selectOIDCClient returns the client, provided it registered redirectURI.
+// Until both are checked, errors must not be sent to the redirect URI.
+func selectOIDCClient(ctx context.Context, db bun.IDB, clientID, redirectURI string) (*OIDCClient, error) {
+	client := new(OIDCClient)
+	err := db.NewSelect().Model(client).Where("id = ?", clientID).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errOIDCClient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			return client, nil
+		}
+	}
+
+	return nil, errOIDCClient
+}
+
+// check returns the OAuth error code and description of an invalid request.
+func (request *OIDCAuthorizeRequest) check() (string, string) {
+	if request.ResponseType != "code" {
+		return "unsupported_response_type", "Only the authorization code flow is supported."
+	}
+
+	scopes := strings.Fields(request.Scope)
+	if !containsString(scopes, OIDCScopeOpenID) {
+		return "invalid_scope", "The openid scope is required."
+	}
+	for _, scope := range scopes {
+		if !containsString(oidcScopes, scope) {
+			return "invalid_scope", "Unknown scope: " + scope + "."
+		}
+	}
+
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return "invalid_request", "PKCE with the S256 method is required."
+	}
+
+	return "", ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func oidcRedirectURL(redirectURI string, values url.Values) string {
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+
+	return redirectURI + separator + values.Encode()
+}
+
+func oidcError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+func memberStatus(user *User, shares uint) string {
+	switch {
+	case shares < minimumShares:
+		return MemberStatusRegistered
+	case !user.Accepted:
+		return MemberStatusPending
+	default:
+		return MemberStatusMember
+	}
+}
+
+// oidcUserClaims returns the claims about the user granted by the scopes.
+func oidcUserClaims(ctx context.Context, db bun.IDB, user *User, scopes []string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{"sub": user.ID}
+
+	if containsString(scopes, OIDCScopeProfile) {
+		claims["name"] = user.FirstName + " " + user.LastName
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+	}
+
+	if containsString(scopes, OIDCScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.Confirmed
+	}
+
+	if containsString(scopes, OIDCScopeMembership) {
+		shares, err := userShares(ctx, db, user)
+		if err != nil {
+			return nil, err
+		}
+
+		claims["member_status"] = memberStatus(user, shares)
+		claims["college"] = user.Category
+		claims["shares"] = shares
+	}
+
+	return claims, nil
+}
+
+func registerOIDCRoutes(r *gin.Engine, authorized, admin *gin.RouterGroup, db *bun.DB, keys *auth.KeySet, issuer, appBaseURL string) {
+	r.GET("/.well-known/openid-configuration", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/oauth/authorize",
+			"token_endpoint":                        issuer + "/oauth/token",
+			"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+			"jwks_uri":                              issuer + "/.well-known/jwks.json",
+			"scopes_supported":                      oidcScopes,
+			"response_types_supported":              []string{"code"},
+			"grant_types_supported":                 []string{"authorization_code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": keys.Algorithms(),
+			"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+			"code_challenge_methods_supported":      []string{"S256"},
+			"claims_supported": []string{
+				"sub", "name", "given_name", "family_name", "email", "email_verified",
+				"member_status", "college", "shares",
+			},
+		})
+	})
+
+	// The member logs in and gives their consent on the app, which then asks
+	// for the authorization code with POST /oauth/authorize.
+	r.GET("/oauth/authorize", func(c *gin.Context) {
+		var request OIDCAuthorizeRequest
+		if err := c.ShouldBindQuery(&request); err != nil {
+			oidcError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		if _, err := selectOIDCClient(c, db, request.ClientID, request.RedirectURI); err != nil {
+			if !errors.Is(err, errOIDCClient) {
+				log.Println(err)
+			}
+
+			oidcError(c, http.StatusBadRequest, "invalid_client", "Unknown client or redirect URI.")
+			return
+		}
+
+		if code, description := request.check(); code != "" {
+			c.Redirect(http.StatusFound, oidcRedirectURL(request.RedirectURI, url.Values{
+				"error":             {code},
+				"error_description": {description},
+				"state":             {request.State},
+			}))
+			return
+		}
+
+		c.Redirect(http.StatusFound, appBaseURL+"oauth/authorize?"+c.Request.URL.RawQuery)
+	})
+
+	r.GET("/oauth/clients/:clientID", func(c *gin.Context) {
+		client := new(OIDCClient)
+		if err := db.NewSelect().Model(client).Where("id = ?", c.Param("clientID")).Scan(c); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				c.JSON(http.StatusNotFound, ErrorResponse{"Client not found.", "not-found"})
+				return
+			}
+
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"id": client.ID, "name": client.Name})
+	})
+
+	authorized.POST("/oauth/authorize", func(c *gin.Context) {
+		var request OIDCAuthorizeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		client, err := selectOIDCClient(c, db, request.ClientID, request.RedirectURI)
+		if err != nil {
+			if errors.Is(err, errOIDCClient) {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"Unknown client or redirect URI.", "oidc-client-invalid"})
+				return
+			}
+
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if code, description := request.check(); code != "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{description, "oidc-request-invalid"})
+			return
+		}
+
+		session := new(Session)
+		if err := db.NewSelect().Model(session).Where("id = ?", c.GetString("sessionID")).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		code, err := auth.NewSecret()
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		oidcCode := &OIDCCode{
+			CodeHash:      auth.HashToken(code),
+			ClientID:      request.ClientID,
+			UserID:        c.GetString("userID"),
+			RedirectURI:   request.RedirectURI,
+			Scope:         request.Scope,
+			CodeChallenge: request.CodeChallenge,
+			AuthTime:      session.CreatedAt,
+			ExpiresAt:     time.Now().Add(oidcCodeDuration),
+		}
+		if request.Nonce != "" {
+			oidcCode.Nonce = &request.Nonce
+		}
+
+		if _, err := db.NewDelete().Table("oidc_codes").Where("expires_at < now()").Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// The consent of the member to share their data with the client is
+		// recorded with the code.
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.NewInsert().Model(oidcCode).Exec(ctx); err != nil {
+				return err
+			}
+
+			consent := &OIDCConsent{
+				UserID:     oidcCode.UserID,
+				ClientID:   client.ID,
+				ClientName: client.Name,
+				Scope:      oidcCode.Scope,
+			}
+			_, err := tx.NewInsert().Model(consent).Exec(ctx)
+			return err
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := writeAudit(c, db, oidcCode.UserID, c.ClientIP(), "oauth.authorize", "user", oidcCode.UserID, map[string]interface{}{
+			"clientId": oidcCode.ClientID,
+			"scope":    oidcCode.Scope,
+		}); err != nil {
+			log.Println(err)
+		}
+
+		values := url.Values{"code": {code}}
+		if request.State != "" {
+			values.Set("state", request.State)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"redirectUrl": oidcRedirectURL(request.RedirectURI, values)})
+	})
+
+	r.POST("/oauth/token", func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+
+		if c.PostForm("grant_type") != "authorization_code" {
+			oidcError(c, http.StatusBadRequest, "unsupported_grant_type", "Only the authorization_code grant is supported.")
+			return
+		}
+
+		clientID, secret, ok := c.Request.BasicAuth()
+		if !ok {
+			clientID = c.PostForm("client_id")
+			secret = c.PostForm("client_secret")
+		}
+
+		client := new(OIDCClient)
+		if err := db.NewSelect().Model(client).Where("id = ?", clientID).Scan(c); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				oidcError(c, http.StatusUnauthorized, "invalid_client", "Unknown client.")
+				return
+			}
+
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		if client.SecretHash != nil && subtle.ConstantTimeCompare([]byte(auth.HashToken(secret)), []byte(*client.SecretHash)) != 1 {
+			oidcError(c, http.StatusUnauthorized, "invalid_client", "Invalid client secret.")
+			return
+		}
+
+		// Deleting the code makes it single use.
+		code := new(OIDCCode)
+		result, err := db.NewDelete().Model(code).Where("code_hash = ?", auth.HashToken(c.PostForm("code"))).Where("client_id = ?", client.ID).Returning("*").Exec(c)
+		if err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 || code.ExpiresAt.Before(time.Now()) {
+			oidcError(c, http.StatusBadRequest, "invalid_grant", "The authorization code is invalid or has expired.")
+			return
+		}
+
+		if code.RedirectURI != c.PostForm("redirect_uri") {
+			oidcError(c, http.StatusBadRequest, "invalid_grant", "The redirect URI does not match the authorization request.")
+			return
+		}
+
+		if !auth.CheckPKCE(c.PostForm("code_verifier"), code.CodeChallenge) {
+			oidcError(c, http.StatusBadRequest, "invalid_grant", "The code verifier is invalid.")
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", code.UserID).Scan(c); err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		now := time.Now()
+
+		claims, err := oidcUserClaims(c, db, user, strings.Fields(code.Scope))
+		if err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+		claims["iss"] = issuer
+		claims["aud"] = client.ID
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(oidcIDTokenDuration).Unix()
+		claims["auth_time"] = code.AuthTime.Unix()
+		if code.Nonce != nil {
+			claims["nonce"] = *code.Nonce
+		}
+
+		idToken, err := keys.Sign(claims)
+		if err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		accessToken, err := keys.Sign(&OIDCAccessTokenClaims{
+			Scope:    code.Scope,
+			ClientID: client.ID,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    issuer,
+				Subject:   user.ID,
+				Audience:  jwt.ClaimStrings{issuer + "/oauth/userinfo"},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(oidcAccessTokenDuration)),
+			},
+		})
+		if err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"access_token": accessToken,
+			"token_type":   "Bearer",
+			"expires_in":   int(oidcAccessTokenDuration.Seconds()),
+			"id_token":     idToken,
+			"scope":        code.Scope,
+		})
+	})
+
+	userinfo := func(c *gin.Context) {
+		claims := new(OIDCAccessTokenClaims)
+		if err := keys.Parse(auth.RequestToken(c), claims); err != nil || claims.Issuer != issuer || !claims.VerifyAudience(issuer+"/oauth/userinfo", true) {
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			oidcError(c, http.StatusUnauthorized, "invalid_token", "The access token is invalid.")
+			return
+		}
+
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", claims.Subject).Scan(c); err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		userClaims, err := oidcUserClaims(c, db, user, strings.Fields(claims.Scope))
+		if err != nil {
+			log.Println(err)
+			oidcError(c, http.StatusInternalServerError, "server_error", "Internal server error.")
+			return
+		}
+
+		c.JSON(http.StatusOK, userClaims)
+	}
+	r.GET("/oauth/userinfo", userinfo)
+	r.POST("/oauth/userinfo", userinfo)
+
+	admin.GET("/oidc/clients", func(c *gin.Context) {
+		clients := make([]*OIDCClient, 0)
+		if err := db.NewSelect().Model(&clients).Order("created_at").Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*OIDCClientResponseItem, 0, len(clients))
+		for _, client := range clients {
+			response = append(response, newOIDCClientResponseItem(client))
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admin.POST("/oidc/clients", func(c *gin.Context) {
+		var json OIDCClientRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		client := &OIDCClient{
+			ID:           uuid.NewString(),
+			Name:         json.Name,
+			RedirectURIs: json.RedirectURIs,
+			CreatedAt:    time.Now(),
+		}
+
+		var secret string
+		if !json.Public {
+			var err error
+			secret, err = auth.NewSecret()
+			if err != nil {
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+				return
+			}
+
+			secretHash := auth.HashToken(secret)
+			client.SecretHash = &secretHash
+		}
+
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if _, err := tx.NewInsert().Model(client).Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "oidc-client.create", "oidc-client", client.ID, map[string]interface{}{
+				"name":         client.Name,
+				"redirectUris": client.RedirectURIs,
+			})
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := newOIDCClientResponseItem(client)
+		if client.SecretHash != nil {
+			response.Secret = &secret
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admin.PUT("/oidc/clients/:clientID", func(c *gin.Context) {
+		var json OIDCClientRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		client := &OIDCClient{ID: c.Param("clientID"), Name: json.Name, RedirectURIs: json.RedirectURIs}
+
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			result, err := tx.NewUpdate().Model(client).Column("name", "redirect_uris").WherePK().Returning("*").Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				return sql.ErrNoRows
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "oidc-client.update", "oidc-client", client.ID, map[string]interface{}{
+				"name":         client.Name,
+				"redirectUris": client.RedirectURIs,
+			})
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Client not found.", "not-found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newOIDCClientResponseItem(client))
+	})
+
+	admin.DELETE("/oidc/clients/:clientID", func(c *gin.Context) {
+		clientID := c.Param("clientID")
+
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			result, err := tx.NewDelete().Table("oidc_clients").Where("id = ?", clientID).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if rows, _ := result.RowsAffected(); rows == 0 {
+				return sql.ErrNoRows
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "oidc-client.delete", "oidc-client", clientID, nil)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Client not found.", "not-found"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/uptrace/bun"
+)
+
+// passkeyChallengeDuration is how long a member has to answer a registration
+// or login ceremony.
+const passkeyChallengeDuration = 5 * time.Minute
+
+type Passkey struct {
+	bun.BaseModel `bun:"table:passkeys"`
+
+	ID           string              `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID       string              `bun:"user_id,notnull"`
+	CredentialID []byte              `bun:"credential_id,unique,notnull"`
+	Credential   webauthn.Credential `bun:"credential,type:jsonb,notnull"`
+	Name         string              `bun:"name,notnull"`
+	CreatedAt    time.Time           `bun:"created_at,notnull,default:current_timestamp"`
+	LastUsedAt   *time.Time          `bun:"last_used_at"`
+}
+
+// PasskeyChallenge keeps the state of a ceremony between its start and its
+// finish. UserID is nil for logins, the member being unknown until they
+// pick a passkey.
+type PasskeyChallenge struct {
+	bun.BaseModel `bun:"table:passkey_challenges"`
+
+	ID        string               `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID    *string              `bun:"user_id"`
+	Session   webauthn.SessionData `bun:"session,type:jsonb,notnull"`
+	ExpiresAt time.Time            `bun:"expires_at,notnull"`
+}
+
+type PasskeyResponseItem struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// StartPasskeyRegistrationRequest asks for the password and the second
+// factor again: a passkey logs in on its own, so a stolen token must not be
+// enough to add one.
+type StartPasskeyRegistrationRequest struct {
+	Password     string `json:"password" binding:"required"`
+	TOTPCode     string `json:"totp_code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type FinishPasskeyRegistrationRequest struct {
+	ChallengeID string          `json:"challenge_id" binding:"required"`
+	Name        string          `json:"name" binding:"required,max=100"`
+	Credential  json.RawMessage `json:"credential" binding:"required"`
+}
+
+type PasskeyAssertion struct {
+	ChallengeID string          `json:"challenge_id" binding:"required"`
+	Credential  json.RawMessage `json:"credential" binding:"required"`
+}
+
+type RenamePasskeyRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+var (
+	errPasskeyChallenge = errors.New("passkey challenge invalid")
+	errPasskeyInvalid   = errors.New("passkey invalid")
+)
+
+// webauthnUser adapts a user and their passkeys to the WebAuthn library. The
+// user handle stored by authenticators is the ID of the user.
+type webauthnUser struct {
+	user     *User
+	passkeys []*Passkey
+}
+
+func (u *webauthnUser) WebAuthnID() []byte {
+	return []byte(u.user.ID)
+}
+
+func (u *webauthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webauthnUser) WebAuthnDisplayName() string {
+	return u.user.FirstName + " " + u.user.LastName
+}
+
+func (u *webauthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.passkeys))
+	for _, passkey := range u.passkeys {
+		credentials = append(credentials, passkey.Credential)
+	}
+
+	return credentials
+}
+
+// newWebAuthn configures the relying party from the URL of the app, which
+// is the only origin allowed to use the passkeys.
+func newWebAuthn(appBaseURL string) (*webauthn.WebAuthn, error) {
+	u, err := url.Parse(appBaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "Entrelac",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+}
+
+func selectWebAuthnUser(ctx context.Context, db bun.IDB, userID string) (*webauthnUser, error) {
+	user := new(User)
+	if err := db.NewSelect().Model(user).Where("id = ?", userID).Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	passkeys := make([]*Passkey, 0)
+	if err := db.NewSelect().Model(&passkeys).Where("user_id = ?", userID).Order("created_at").Scan(ctx); err != nil {
+		return nil, err
+	}
+
+	return &webauthnUser{user, passkeys}, nil
+}
+
+func savePasskeyChallenge(ctx context.Context, db bun.IDB, userID *string, session *webauthn.SessionData) (string, error) {
+	if _, err := db.NewDelete().Table("passkey_challenges").Where("expires_at < now()").Exec(ctx); err != nil {
+		return "", err
+	}
+
+	challenge := &PasskeyChallenge{
+		UserID:    userID,
+		Session:   *session,
+		ExpiresAt: time.Now().Add(passkeyChallengeDuration),
+	}
+	if _, err := db.NewInsert().Model(challenge).Returning("id").Exec(ctx); err != nil {
+		return "", err
+	}
+
+	return challenge.ID, nil
+}
+
+// takePasskeyChallenge returns the state of a ceremony and deletes it, so that
+// each challenge is answered at most once.
+func takePasskeyChallenge(ctx context.Context, db bun.IDB, challengeID string, userID *string) (*PasskeyChallenge, error) {
+	challenge := new(PasskeyChallenge)
+	query := db.NewDelete().Model(challenge).Where("id = ?", challengeID).Where("expires_at > now()")
+	if userID != nil {
+		query = query.Where("user_id = ?", *userID)
+	} else {
+		query = query.Where("user_id IS NULL")
+	}
+
+	result, err := query.Returning("*").Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, errPasskeyChallenge
+	}
+
+	return challenge, nil
+}
+
+// loginWithPasskey checks a passkey assertion, returning its user. The
+// signature counter of the passkey is updated along the way.
+func loginWithPasskey(ctx context.Context, db bun.IDB, wa *webauthn.WebAuthn, assertion *PasskeyAssertion) (*User, error) {
+	challenge, err := takePasskeyChallenge(ctx, db, assertion.ChallengeID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(assertion.Credential))
+	if err != nil {
+		return nil, errPasskeyInvalid
+	}
+
+	var owner *webauthnUser
+	credential, err := wa.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err := selectWebAuthnUser(ctx, db, string(userHandle))
+		owner = user
+		return user, err
+	}, challenge.Session, parsed)
+	if err != nil {
+		return nil, errPasskeyInvalid
+	}
+
+	for _, passkey := range owner.passkeys {
+		if !bytes.Equal(passkey.CredentialID, credential.ID) {
+			continue
+		}
+
+		now := time.Now()
+		passkey.Credential.Authenticator = credential.Authenticator
+		passkey.Credential.Flags.BackupState = credential.Flags.BackupState
+		passkey.LastUsedAt = &now
+		if _, err := db.NewUpdate().Model(passkey).Column("credential", "last_used_at").WherePK().Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return owner.user, nil
+}
+
+func registerPasskeyRoutes(r *gin.Engine, authorized *gin.RouterGroup, db *bun.DB, wa *webauthn.WebAuthn, key []byte) {
+	r.POST("/passkeys/login/start", func(c *gin.Context) {
+		assertion, session, err := wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		challengeID, err := savePasskeyChallenge(c, db, nil, session)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"challengeId": challengeID,
+			"options":     assertion,
+		})
+	})
+
+	authorized.POST("/users/me/passkeys/registration/start", func(c *gin.Context) {
+		userID := c.GetString("userID")
+
+		var json StartPasskeyRegistrationRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user, err := selectWebAuthnUser(c, db, userID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// Logging in with a passkey counts as two factors, which admins only
+		// get from a session opened with one.
+		if isStaff(user.user) && !c.GetBool("mfa") {
+			c.JSON(http.StatusForbidden, ErrorResponse{"Two-factor authentication is required to add a passkey.", "mfa-required"})
+			return
+		}
+
+		accountKey := accountThrottleKey("passkey", userID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		if !checkSecondFactor(c, db, key, user.user, json.TOTPCode, json.RecoveryCode, accountKey) {
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		exclusions := make([]protocol.CredentialDescriptor, 0, len(user.passkeys))
+		for _, credential := range user.WebAuthnCredentials() {
+			exclusions = append(exclusions, credential.Descriptor())
+		}
+
+		creation, session, err := wa.BeginRegistration(user,
+			webauthn.WithExclusions(exclusions),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+			webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+				UserVerification: protocol.VerificationRequired,
+			}),
+		)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		challengeID, err := savePasskeyChallenge(c, db, &userID, session)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"challengeId": challengeID,
+			"options":     creation,
+		})
+	})
+
+	authorized.POST("/users/me/passkeys/registration/finish", func(c *gin.Context) {
+		userID := c.GetString("userID")
+
+		var json FinishPasskeyRegistrationRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		challenge, err := takePasskeyChallenge(c, db, json.ChallengeID, &userID)
+		if errors.Is(err, errPasskeyChallenge) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This challenge is invalid or has expired.", "passkey-challenge-invalid"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		user, err := selectWebAuthnUser(c, db, userID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(json.Credential))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This passkey is invalid.", "passkey-invalid"})
+			return
+		}
+
+		credential, err := wa.CreateCredential(user, challenge.Session, parsed)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This passkey is invalid.", "passkey-invalid"})
+			return
+		}
+
+		passkey := &Passkey{
+			UserID:       userID,
+			CredentialID: credential.ID,
+			Credential:   *credential,
+			Name:         json.Name,
+		}
+		if _, err := db.NewInsert().Model(passkey).Returning("id, created_at").Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := writeAudit(c, db, passkey.UserID, c.ClientIP(), "passkey.create", "user", passkey.UserID, map[string]interface{}{
+			"passkeyId": passkey.ID,
+		}); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, PasskeyResponseItem{
+			ID:        passkey.ID,
+			Name:      passkey.Name,
+			CreatedAt: passkey.CreatedAt,
+		})
+	})
+
+	authorized.GET("/users/me/passkeys", func(c *gin.Context) {
+		passkeys := make([]*Passkey, 0)
+		if err := db.NewSelect().Model(&passkeys).Where("user_id = ?", c.GetString("userID")).Order("created_at").Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]PasskeyResponseItem, 0, len(passkeys))
+		for _, passkey := range passkeys {
+			response = append(response, PasskeyResponseItem{
+				ID:         passkey.ID,
+				Name:       passkey.Name,
+				CreatedAt:  passkey.CreatedAt,
+				LastUsedAt: passkey.LastUsedAt,
+			})
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	authorized.PATCH("/users/me/passkeys/:passkeyID", func(c *gin.Context) {
+		var json RenamePasskeyRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		passkey := &Passkey{ID: c.Param("passkeyID"), Name: json.Name}
+		result, err := db.NewUpdate().Model(passkey).Column("name").WherePK().Where("user_id = ?", c.GetString("userID")).Returning("created_at, last_used_at").Exec(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Passkey not found.", "not-found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, PasskeyResponseItem{
+			ID:         passkey.ID,
+			Name:       passkey.Name,
+			CreatedAt:  passkey.CreatedAt,
+			LastUsedAt: passkey.LastUsedAt,
+		})
+	})
+
+	authorized.DELETE("/users/me/passkeys/:passkeyID", func(c *gin.Context) {
+		result, err := db.NewDelete().Table("passkeys").Where("id = ?", c.Param("passkeyID")).Where("user_id = ?", c.GetString("userID")).Exec(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Passkey not found.", "not-found"})
+			return
+		}
+
+		if err := writeAudit(c, db, c.GetString("userID"), c.ClientIP(), "passkey.delete", "user", c.GetString("userID"), map[string]interface{}{
+			"passkeyId": c.Param("passkeyID"),
+		}); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type CheckPasswordRequest struct {
+	Password  string `json:"password" binding:"required"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type PasswordPolicyErrorResponse struct {
+	Error    string   `json:"error"`
+	Code     string   `json:"code"`
+	Score    int      `json:"score"`
+	Feedback []string `json:"feedback"`
+}
+
+// checkPasswordPolicy refuses the password, explaining why with the feedback
+// codes, if it is too easy to guess.
+func checkPasswordPolicy(c *gin.Context, password string, userInputs ...string) bool {
+	strength := auth.CheckPasswordStrength(password, userInputs...)
+	if !strength.Acceptable {
+		c.JSON(http.StatusBadRequest, PasswordPolicyErrorResponse{"The password is too weak.", "password-policy", strength.Score, strength.Feedback})
+		return false
+	}
+
+	return true
+}
+
+func registerPasswordRoutes(r *gin.Engine) {
+	// The sign-up form checks the password as it is typed.
+	r.POST("/passwords/check", func(c *gin.Context) {
+		var json CheckPasswordRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		c.JSON(http.StatusOK, auth.CheckPasswordStrength(json.Password, json.Email, json.FirstName, json.LastName))
+	})
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v73"
+	"github.com/stripe/stripe-go/v73/customer"
+	"github.com/uptrace/bun"
+)
+
+// ProfileChange keeps a previous value of the profile of a member: the legal
+// register of the members must show how their addresses changed over time.
+type ProfileChange struct {
+	bun.BaseModel `bun:"table:profile_changes"`
+
+	ID              string    `bun:"id,pk,type:uuid,default:gen_random_uuid()" json:"id"`
+	UserID          string    `bun:"user_id,notnull" json:"userId"`
+	Field           string    `bun:"field,notnull" json:"field"`
+	PreviousValue   string    `bun:"previous_value,notnull" json:"previousValue"`
+	NewValue        string    `bun:"new_value,notnull" json:"newValue"`
+	ChangedByUserID *string   `bun:"changed_by_user_id" json:"changedByUserId"`
+	CreatedAt       time.Time `bun:"created_at,notnull,default:current_timestamp" json:"createdAt"`
+}
+
+// UpdateProfileRequest only changes the fields which are given. The email
+// address is changed through POST /users/me/email, which checks it first.
+type UpdateProfileRequest struct {
+	PhoneNumber *string `json:"phone_number" binding:"omitempty,max=30"`
+	FirstName   *string `json:"first_name" binding:"omitempty,max=100"`
+	LastName    *string `json:"last_name" binding:"omitempty,max=100"`
+	Address     *string `json:"address" binding:"omitempty,max=200"`
+	PostalCode  *string `json:"postal_code" binding:"omitempty,max=20"`
+	City        *string `json:"city" binding:"omitempty,max=100"`
+	Country     *string `json:"country" binding:"omitempty,max=100"`
+}
+
+var phoneNumberPattern = regexp.MustCompile(`^\+?[0-9 ().-]{6,}$`)
+
+var errProfileFieldInvalid = errors.New("profile field invalid")
+
+// profileField is a column of the profile, with its value in a user.
+type profileField struct {
+	column string
+	value  func(user *User) *string
+}
+
+var profileFields = []profileField{
+	{"email", func(user *User) *string { return &user.Email }},
+	{"phone_number", func(user *User) *string { return &user.PhoneNumber }},
+	{"first_name", func(user *User) *string { return &user.FirstName }},
+	{"last_name", func(user *User) *string { return &user.LastName }},
+	{"address", func(user *User) *string { return &user.Address }},
+	{"postal_code", func(user *User) *string { return &user.PostalCode }},
+	{"city", func(user *User) *string { return &user.City }},
+	{"country", func(user *User) *string { return &user.Country }},
+}
+
+// recordProfileChanges keeps the previous values of the fields which differ
+// between before and after, returning the columns which changed.
+func recordProfileChanges(ctx context.Context, db bun.IDB, before, after *User, actorUserID string) ([]string, error) {
+	var changes []*ProfileChange
+	var columns []string
+	for _, field := range profileFields {
+		previousValue, newValue := *field.value(before), *field.value(after)
+		if previousValue == newValue {
+			continue
+		}
+
+		change := &ProfileChange{
+			UserID:        before.ID,
+			Field:         field.column,
+			PreviousValue: previousValue,
+			NewValue:      newValue,
+			CreatedAt:     time.Now(),
+		}
+		if actorUserID != "" {
+			change.ChangedByUserID = &actorUserID
+		}
+
+		changes = append(changes, change)
+		columns = append(columns, field.column)
+	}
+
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	if _, err := db.NewInsert().Model(&changes).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return columns, nil
+}
+
+// applyProfileUpdate copies the given fields of the request into the user,
+// refusing blank values.
+func applyProfileUpdate(user *User, json *UpdateProfileRequest) (string, error) {
+	updates := []struct {
+		column string
+		value  *string
+		target *string
+	}{
+		{"phone_number", json.PhoneNumber, &user.PhoneNumber},
+		{"first_name", json.FirstName, &user.FirstName},
+		{"last_name", json.LastName, &user.LastName},
+		{"address", json.Address, &user.Address},
+		{"postal_code", json.PostalCode, &user.PostalCode},
+		{"city", json.City, &user.City},
+		{"country", json.Country, &user.Country},
+	}
+
+	for _, update := range updates {
+		if update.value == nil {
+			continue
+		}
+
+		value := strings.TrimSpace(*update.value)
+		if value == "" {
+			return update.column, errProfileFieldInvalid
+		}
+		if update.column == "phone_number" && !phoneNumberPattern.MatchString(value) {
+			return update.column, errProfileFieldInvalid
+		}
+
+		*update.target = value
+	}
+
+	return "", nil
+}
+
+func registerProfileRoutes(authorized *gin.RouterGroup, members *gin.RouterGroup, db *bun.DB) {
+	authorized.PATCH("/users/me", func(c *gin.Context) {
+		var json UpdateProfileRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		userID := c.GetString("userID")
+
+		user := new(User)
+		var invalidField string
+		var renamed bool
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := tx.NewSelect().Model(user).Where("id = ?", userID).For("UPDATE").Scan(ctx); err != nil {
+				return err
+			}
+
+			before := *user
+			field, err := applyProfileUpdate(user, &json)
+			if err != nil {
+				invalidField = field
+				return err
+			}
+
+			columns, err := recordProfileChanges(ctx, tx, &before, user, userID)
+			if err != nil {
+				return err
+			}
+			if len(columns) == 0 {
+				return nil
+			}
+
+			if _, err := tx.NewUpdate().Model(user).Column(columns...).WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			if err := writeAudit(ctx, tx, userID, c.ClientIP(), "profile.update", "user", userID, map[string]interface{}{
+				"fields": columns,
+			}); err != nil {
+				return err
+			}
+
+			renamed = before.FirstName != user.FirstName || before.LastName != user.LastName
+			return nil
+		})
+		if errors.Is(err, errProfileFieldInvalid) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"The field " + invalidField + " is invalid.", strings.ReplaceAll(invalidField, "_", "-") + "-invalid"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		// Only the name of the member is copied to their Stripe customer, for
+		// the invoices. A failure does not undo the committed change: it is
+		// logged, and the next renaming sets the name again.
+		if renamed {
+			if _, err := customer.Update(user.Customer, &stripe.CustomerParams{Name: stripe.String(user.FirstName + " " + user.LastName)}); err != nil {
+				log.Printf("error updating the name of Stripe customer %s: %v", user.Customer, err)
+			}
+		}
+
+		c.JSON(http.StatusOK, profileResponse(user))
+	})
+
+	authorized.GET("/users/me/profile-history", func(c *gin.Context) {
+		respondProfileHistory(c, db, c.GetString("userID"))
+	})
+
+	members.GET("/users/:userID/profile-history", func(c *gin.Context) {
+		respondProfileHistory(c, db, c.Param("userID"))
+	})
+}
+
+func profileResponse(user *User) gin.H {
+	return gin.H{
+		"email":       user.Email,
+		"phoneNumber": user.PhoneNumber,
+		"firstName":   user.FirstName,
+		"lastName":    user.LastName,
+		"address":     user.Address,
+		"postalCode":  user.PostalCode,
+		"city":        user.City,
+		"country":     user.Country,
+	}
+}
+
+func respondProfileHistory(c *gin.Context, db *bun.DB, userID string) {
+	changes := make([]*ProfileChange, 0)
+	if err := db.NewSelect().Model(&changes).Where("user_id = ?", userID).Order("created_at DESC").Scan(c); err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
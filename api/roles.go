@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+// The roles which can be given to users, replacing the single admin flag: the
+// volunteers answering questions should not see identity documents.
+const (
+	RoleVolunteer     = "volunteer"
+	RoleTreasurer     = "treasurer"
+	RoleSecretary     = "secretary"
+	RoleAdministrator = "administrator"
+)
+
+var rolesPermissions = map[string][]string{
+	RoleVolunteer: {
+		auth.PermissionViewMembers,
+	},
+	RoleTreasurer: {
+		auth.PermissionViewMembers,
+		auth.PermissionRecordPayments,
+	},
+	RoleSecretary: {
+		auth.PermissionViewMembers,
+		auth.PermissionViewDocuments,
+		auth.PermissionEditMembers,
+		auth.PermissionManageAssemblies,
+	},
+	RoleAdministrator: {
+		auth.PermissionViewMembers,
+		auth.PermissionViewDocuments,
+		auth.PermissionEditMembers,
+		auth.PermissionRecordPayments,
+		auth.PermissionManageAssemblies,
+		auth.PermissionManageAdmins,
+	},
+}
+
+type UpdateUserRolesRequest struct {
+	Roles []string `json:"roles" binding:"required,dive,required"`
+}
+
+type RoleResponseItem struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type StaffResponseItem struct {
+	ID        string   `json:"id"`
+	Email     string   `json:"email"`
+	FirstName string   `json:"firstName"`
+	LastName  string   `json:"lastName"`
+	Roles     []string `json:"roles"`
+	TOTP      bool     `json:"totp"`
+}
+
+var errLastAdministrator = errors.New("last administrator")
+
+// rolesPermissionsOf returns the permissions granted by the roles, sorted and
+// without duplicates.
+func rolesPermissionsOf(roles []string) []string {
+	set := map[string]bool{}
+	for _, role := range roles {
+		for _, permission := range rolesPermissions[role] {
+			set[permission] = true
+		}
+	}
+
+	permissions := make([]string, 0, len(set))
+	for permission := range set {
+		permissions = append(permissions, permission)
+	}
+	sort.Strings(permissions)
+
+	return permissions
+}
+
+// isStaff tells whether the user holds a role, and thus has to use two-factor
+// authentication.
+func isStaff(user *User) bool {
+	return len(user.Roles) > 0
+}
+
+func registerRoleRoutes(admins *gin.RouterGroup, db *bun.DB) {
+	admins.GET("/roles", func(c *gin.Context) {
+		response := make([]*RoleResponseItem, 0, len(rolesPermissions))
+		for name, permissions := range rolesPermissions {
+			response = append(response, &RoleResponseItem{name, permissions})
+		}
+		sort.Slice(response, func(i, j int) bool {
+			return response[i].Name < response[j].Name
+		})
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admins.GET("/staff", func(c *gin.Context) {
+		users := make([]*User, 0)
+		if err := db.NewSelect().Model(&users).Where("cardinality(roles) > 0").Order("email ASC").Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]*StaffResponseItem, 0, len(users))
+		for _, user := range users {
+			response = append(response, &StaffResponseItem{
+				ID:        user.ID,
+				Email:     user.Email,
+				FirstName: user.FirstName,
+				LastName:  user.LastName,
+				Roles:     user.Roles,
+				TOTP:      user.TOTPEnabledAt != nil,
+			})
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	admins.PUT("/users/:userID/roles", func(c *gin.Context) {
+		var json UpdateUserRolesRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		roles := make([]string, 0, len(json.Roles))
+		for _, role := range json.Roles {
+			if _, ok := rolesPermissions[role]; !ok {
+				c.JSON(http.StatusBadRequest, ErrorResponse{"Unknown role: " + role + ".", "role-unknown"})
+				return
+			}
+			if !containsString(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+		sort.Strings(roles)
+
+		user := new(User)
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			// Locking the administrators keeps two of them from removing each
+			// other at the same time.
+			var administrators []string
+			if err := tx.NewSelect().Table("users").Column("id").Where("? = ANY(roles)", RoleAdministrator).For("UPDATE").Scan(ctx, &administrators); err != nil {
+				return err
+			}
+
+			if err := tx.NewSelect().Model(user).Where("id = ?", c.Param("userID")).For("UPDATE").Scan(ctx); err != nil {
+				return err
+			}
+
+			if len(administrators) == 1 && administrators[0] == user.ID && !containsString(roles, RoleAdministrator) {
+				return errLastAdministrator
+			}
+
+			previousRoles := user.Roles
+			user.Roles = roles
+			if _, err := tx.NewUpdate().Model(user).Column("roles").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			// The tokens carry the permissions: removing a role must not wait
+			// for them to expire.
+			for _, role := range previousRoles {
+				if !containsString(roles, role) {
+					if err := revokeSessions(ctx, tx, user.ID); err != nil {
+						return err
+					}
+					break
+				}
+			}
+
+			return writeAudit(ctx, tx, c.GetString("userID"), c.ClientIP(), "roles.update", "user", user.ID, map[string]interface{}{
+				"before": previousRoles,
+				"after":  roles,
+			})
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"No user exists with this ID.", "id-unknown"})
+			return
+		}
+		if errors.Is(err, errLastAdministrator) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"At least one administrator must remain.", "last-administrator"})
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"roles": user.Roles})
+	})
+}
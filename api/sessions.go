@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+type Session struct {
+	bun.BaseModel `bun:"table:sessions"`
+
+	ID                       string     `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID                   string     `bun:"user_id,notnull"`
+	RefreshTokenHash         string     `bun:"refresh_token_hash,unique,notnull"`
+	PreviousRefreshTokenHash *string    `bun:"previous_refresh_token_hash"`
+	UserAgent                string     `bun:"user_agent,notnull"`
+	IP                       string     `bun:"ip,notnull"`
+	CreatedAt                time.Time  `bun:"created_at,notnull,default:current_timestamp"`
+	LastUsedAt               time.Time  `bun:"last_used_at,notnull,default:current_timestamp"`
+	ExpiresAt                time.Time  `bun:"expires_at,notnull"`
+	RevokedAt                *time.Time `bun:"revoked_at"`
+	MFA                      bool       `bun:"mfa,notnull,default:false"`
+	ImpersonatorUserID       *string    `bun:"impersonator_user_id"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type SessionResponseItem struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"`
+}
+
+var (
+	errRefreshTokenInvalid = errors.New("refresh token invalid")
+	errRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+func sessionValidator(db *bun.DB) auth.SessionValidator {
+	return func(ctx context.Context, sessionID string) error {
+		exists, err := db.NewSelect().Table("sessions").Where("id = ?", sessionID).Where("revoked_at IS NULL").Where("expires_at > now()").Exists(ctx)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return auth.ErrSessionRevoked
+		}
+
+		return nil
+	}
+}
+
+func tokensResponse(keys *auth.KeySet, session *Session, user *User, refreshToken string) (gin.H, error) {
+	token, err := auth.NewToken(keys, session.ID, user.ID, rolesPermissionsOf(user.Roles), session.MFA)
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":        token,
+		"refreshToken": refreshToken,
+		"expiresAt":    time.Now().Add(auth.AccessTokenDuration),
+	}, nil
+}
+
+// startSession opens a new session for the user, returning the tokens to
+// send back to them. mfa tells whether they gave a second factor.
+func startSession(c *gin.Context, db bun.IDB, keys *auth.KeySet, user *User, mfa bool) (gin.H, error) {
+	refreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		UserID:           user.ID,
+		RefreshTokenHash: auth.HashToken(refreshToken),
+		UserAgent:        c.Request.UserAgent(),
+		IP:               c.ClientIP(),
+		ExpiresAt:        time.Now().Add(auth.RefreshTokenDuration),
+		MFA:              mfa,
+	}
+
+	if _, err := db.NewInsert().Model(session).Returning("id").Exec(c); err != nil {
+		return nil, err
+	}
+
+	if err := writeAudit(c, db, user.ID, c.ClientIP(), "session.create", "user", user.ID, map[string]interface{}{
+		"sessionId": session.ID,
+		"mfa":       mfa,
+	}); err != nil {
+		return nil, err
+	}
+
+	return tokensResponse(keys, session, user, refreshToken)
+}
+
+// refreshSession rotates the refresh token of a session. Presenting a refresh
+// token which was already rotated means it was stolen: the whole session is
+// revoked.
+func refreshSession(c *gin.Context, db *bun.DB, keys *auth.KeySet, refreshToken string) (gin.H, error) {
+	var response gin.H
+	hash := auth.HashToken(refreshToken)
+
+	err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+		session := new(Session)
+		err := tx.NewSelect().Model(session).Where("refresh_token_hash = ?", hash).For("UPDATE").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errRefreshTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		if session.RevokedAt != nil || session.ExpiresAt.Before(time.Now()) {
+			return errRefreshTokenInvalid
+		}
+
+		user := new(User)
+		if err := tx.NewSelect().Model(user).Where("id = ?", session.UserID).Scan(ctx); err != nil {
+			return err
+		}
+
+		newRefreshToken, err := auth.NewRefreshToken()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		previousRefreshTokenHash := session.RefreshTokenHash
+		session.PreviousRefreshTokenHash = &previousRefreshTokenHash
+		session.RefreshTokenHash = auth.HashToken(newRefreshToken)
+		session.UserAgent = c.Request.UserAgent()
+		session.IP = c.ClientIP()
+		session.LastUsedAt = now
+		session.ExpiresAt = now.Add(auth.RefreshTokenDuration)
+
+		_, err = tx.NewUpdate().Model(session).Column("refresh_token_hash", "previous_refresh_token_hash", "user_agent", "ip", "last_used_at", "expires_at").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		response, err = tokensResponse(keys, session, user, newRefreshToken)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenInvalid) {
+		result, err := db.NewUpdate().Table("sessions").Set("revoked_at = now()").Where("previous_refresh_token_hash = ?", hash).Where("revoked_at IS NULL").Exec(c)
+		if err != nil {
+			return nil, err
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			return nil, errRefreshTokenReused
+		}
+
+		return nil, errRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func revokeSessions(ctx context.Context, db bun.IDB, userID string) error {
+	_, err := db.NewUpdate().Table("sessions").Set("revoked_at = now()").Where("user_id = ?", userID).Where("revoked_at IS NULL").Exec(ctx)
+	return err
+}
+
+func registerSessionRoutes(r *gin.Engine, authorized *gin.RouterGroup, db *bun.DB, keys *auth.KeySet) {
+	// Other services verify our tokens, and the OpenID Connect ones, with
+	// these keys.
+	r.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.JSON(http.StatusOK, keys.JWKS())
+	})
+
+	r.POST("/tokens/refresh", func(c *gin.Context) {
+		var json RefreshTokenRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		response, err := refreshSession(c, db, keys, json.RefreshToken)
+		if err != nil {
+			switch {
+			case errors.Is(err, errRefreshTokenInvalid):
+				c.JSON(http.StatusBadRequest, ErrorResponse{"This refresh token is invalid.", "refresh-token-invalid"})
+			case errors.Is(err, errRefreshTokenReused):
+				c.JSON(http.StatusBadRequest, ErrorResponse{"This refresh token was already used, the session has been revoked.", "session-revoked"})
+			default:
+				log.Println(err)
+				c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	authorized.GET("/users/me/sessions", func(c *gin.Context) {
+		userID := c.GetString("userID")
+		sessionID := c.GetString("sessionID")
+
+		sessions := make([]*Session, 0)
+		err := db.NewSelect().Model(&sessions).Where("user_id = ?", userID).Where("impersonator_user_id IS NULL").Where("revoked_at IS NULL").Where("expires_at > now()").Order("last_used_at DESC").Scan(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		response := make([]SessionResponseItem, 0, len(sessions))
+		for _, session := range sessions {
+			response = append(response, SessionResponseItem{
+				ID:         session.ID,
+				UserAgent:  session.UserAgent,
+				IP:         session.IP,
+				CreatedAt:  session.CreatedAt,
+				LastUsedAt: session.LastUsedAt,
+				ExpiresAt:  session.ExpiresAt,
+				Current:    session.ID == sessionID,
+			})
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	// Logging out is revoking the current session.
+	authorized.DELETE("/users/me/sessions/:sessionID", func(c *gin.Context) {
+		userID := c.GetString("userID")
+
+		sessionID := c.Param("sessionID")
+		if sessionID == "current" {
+			sessionID = c.GetString("sessionID")
+		}
+
+		result, err := db.NewUpdate().Table("sessions").Set("revoked_at = now()").Where("id = ?", sessionID).Where("user_id = ?", userID).Where("revoked_at IS NULL").Exec(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusNotFound, ErrorResponse{"Session not found.", "not-found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	authorized.DELETE("/users/me/sessions", func(c *gin.Context) {
+		if err := revokeSessions(c, db, c.GetString("userID")); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := writeAudit(c, db, c.GetString("userID"), c.ClientIP(), "sessions.revoke", "user", c.GetString("userID"), nil); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+// throttlePolicy locks a key out once it has failed maxFailures times within
+// window, for lockout at first and then twice as long after each new failure,
+// up to maxLockout.
+type throttlePolicy struct {
+	maxFailures int
+	lockout     time.Duration
+	maxLockout  time.Duration
+	window      time.Duration
+}
+
+var (
+	accountThrottlePolicy = throttlePolicy{5, time.Minute, time.Hour, 24 * time.Hour}
+	ipThrottlePolicy      = throttlePolicy{20, time.Minute, time.Hour, time.Hour}
+)
+
+type throttleKey struct {
+	key    string
+	policy throttlePolicy
+}
+
+type AuthAttempt struct {
+	bun.BaseModel `bun:"table:auth_attempts"`
+
+	Key         string     `bun:"key,pk"`
+	Failures    int        `bun:"failures,notnull"`
+	LockedUntil *time.Time `bun:"locked_until"`
+	UpdatedAt   time.Time  `bun:"updated_at,notnull"`
+}
+
+func accountThrottleKey(flow, userID string) throttleKey {
+	return throttleKey{flow + ":user:" + userID, accountThrottlePolicy}
+}
+
+func ipThrottleKey(c *gin.Context) throttleKey {
+	return throttleKey{"ip:" + c.ClientIP(), ipThrottlePolicy}
+}
+
+func (policy throttlePolicy) lockoutFor(failures int) time.Duration {
+	if failures < policy.maxFailures {
+		return 0
+	}
+
+	lockout := float64(policy.lockout) * math.Pow(2, float64(failures-policy.maxFailures))
+	if lockout > float64(policy.maxLockout) {
+		return policy.maxLockout
+	}
+
+	return time.Duration(lockout)
+}
+
+// lockedOut returns how long the most restricted of the keys is still locked
+// out for.
+func lockedOut(ctx context.Context, db bun.IDB, keys ...throttleKey) (time.Duration, error) {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.key)
+	}
+
+	var lockedUntil *time.Time
+	err := db.NewSelect().Table("auth_attempts").ColumnExpr("MAX(locked_until)").Where("key IN (?)", bun.In(names)).Where("locked_until > now()").Scan(ctx, &lockedUntil)
+	if err != nil || lockedUntil == nil {
+		return 0, err
+	}
+
+	return time.Until(*lockedUntil), nil
+}
+
+// recordFailedAttempt counts a failure for each key, locking them out as their
+// policy says. The number of failures of the first key is returned.
+func recordFailedAttempt(ctx context.Context, db bun.IDB, keys ...throttleKey) (int, error) {
+	var first int
+
+	for i, key := range keys {
+		attempt := &AuthAttempt{Key: key.key, Failures: 1, UpdatedAt: time.Now()}
+		_, err := db.NewInsert().Model(attempt).
+			On("CONFLICT (key) DO UPDATE").
+			Set("failures = CASE WHEN auth_attempts.updated_at < ? THEN 1 ELSE auth_attempts.failures + 1 END", time.Now().Add(-key.policy.window)).
+			Set("updated_at = EXCLUDED.updated_at").
+			Returning("failures").
+			Exec(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		if lockout := key.policy.lockoutFor(attempt.Failures); lockout > 0 {
+			lockedUntil := time.Now().Add(lockout)
+			attempt.LockedUntil = &lockedUntil
+			if _, err := db.NewUpdate().Model(attempt).Column("locked_until").WherePK().Exec(ctx); err != nil {
+				return 0, err
+			}
+		}
+
+		if i == 0 {
+			first = attempt.Failures
+		}
+	}
+
+	return first, nil
+}
+
+func clearFailedAttempts(ctx context.Context, db bun.IDB, keys ...throttleKey) error {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.key)
+	}
+
+	_, err := db.NewDelete().Table("auth_attempts").Where("key IN (?)", bun.In(names)).Exec(ctx)
+	return err
+}
+
+// checkThrottle responds with a 429 if one of the keys is locked out, in
+// which case the handler must stop.
+func checkThrottle(c *gin.Context, db bun.IDB, keys ...throttleKey) bool {
+	wait, err := lockedOut(c, db, keys...)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+		return false
+	}
+
+	if wait > 0 {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		c.JSON(http.StatusTooManyRequests, ErrorResponse{"Too many failed attempts, please try again later.", "too-many-attempts"})
+		return false
+	}
+
+	return true
+}
+
+func cleanUpAuthAttempts(ctx context.Context, db bun.IDB) error {
+	_, err := db.NewDelete().Table("auth_attempts").Where("updated_at < ?", time.Now().Add(-accountThrottlePolicy.window)).Where("locked_until IS NULL OR locked_until < now()").Exec(ctx)
+	return err
+}
+
+// failFlowCode counts a wrong code given to confirm an account or reset its
+// password. Once the account is locked out, the code is voided and a new one
+// must be requested.
+func failFlowCode(c *gin.Context, db bun.IDB, user *User, column string, accountKey, ipKey throttleKey) {
+	failures, err := recordFailedAttempt(c, db, accountKey, ipKey)
+	if err != nil {
+		log.Println(err)
+	}
+
+	if failures >= accountKey.policy.maxFailures {
+		_, err := db.NewUpdate().Model(user).Set("? = NULL", bun.Ident(column)).Set("? = NULL", bun.Ident(column+"_expires_at")).WherePK().Exec(c)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	c.JSON(http.StatusUnauthorized, ErrorResponse{"This token is invalid.", "bad-token"})
+}
+
+func runAuthAttemptsCleanUp(db *bun.DB) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		if err := cleanUpAuthAttempts(context.Background(), db); err != nil {
+			log.Printf("error cleaning up auth attempts: %v", err)
+		}
+
+		<-ticker.C
+	}
+}
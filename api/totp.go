@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"gitea.nichijou.dev/johynpapin/entrelac-server/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/uptrace/bun"
+)
+
+const totpIssuer = "Entrelac"
+
+type RecoveryCode struct {
+	bun.BaseModel `bun:"table:recovery_codes"`
+
+	ID        string     `bun:"id,pk,type:uuid,default:gen_random_uuid()"`
+	UserID    string     `bun:"user_id,notnull"`
+	CodeHash  string     `bun:"code_hash,notnull"`
+	CreatedAt time.Time  `bun:"created_at,notnull,default:current_timestamp"`
+	UsedAt    *time.Time `bun:"used_at"`
+}
+
+type StartTOTPRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type RegenerateRecoveryCodesRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type DisableTOTPRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// useTOTPCode checks a TOTP code of the user, refusing a code which was
+// already used.
+func useTOTPCode(ctx context.Context, db bun.IDB, user *User, code string) (bool, error) {
+	if user.TOTPSecret == nil {
+		return false, nil
+	}
+
+	step, ok := auth.CheckTOTP(*user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	result, err := db.NewUpdate().Model(user).Set("totp_last_step = ?", step).WherePK().Where("totp_last_step IS NULL OR totp_last_step < ?", step).Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+
+	return rows > 0, nil
+}
+
+// hashRecoveryCode keys the hash of the recovery codes, which are too short
+// to resist a brute force of their hash if the database leaked.
+func hashRecoveryCode(key []byte, code string) string {
+	return auth.HashCode(key, auth.NormalizeRecoveryCode(code))
+}
+
+func useRecoveryCode(ctx context.Context, db bun.IDB, key []byte, user *User, code string) (bool, error) {
+	// The codes generated before their hash was keyed are still accepted,
+	// until the member generates new ones.
+	hashes := []string{hashRecoveryCode(key, code), auth.HashToken(auth.NormalizeRecoveryCode(code))}
+
+	result, err := db.NewUpdate().Table("recovery_codes").Set("used_at = now()").Where("user_id = ?", user.ID).Where("code_hash IN (?)", bun.In(hashes)).Where("used_at IS NULL").Exec(ctx)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+
+	return rows > 0, nil
+}
+
+// checkSecondFactor responds with an error unless the user gave a valid TOTP
+// or recovery code, in which case the handler must stop. Users who did not
+// enable two-factor authentication always pass.
+func checkSecondFactor(c *gin.Context, db bun.IDB, key []byte, user *User, totpCode, recoveryCode string, keys ...throttleKey) bool {
+	if user.TOTPEnabledAt == nil {
+		return true
+	}
+
+	if totpCode == "" && recoveryCode == "" {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{"A two-factor authentication code is required.", "totp-required"})
+		return false
+	}
+
+	var ok bool
+	var err error
+	if totpCode != "" {
+		ok, err = useTOTPCode(c, db, user, totpCode)
+	} else {
+		ok, err = useRecoveryCode(c, db, key, user, recoveryCode)
+	}
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+		return false
+	}
+
+	if !ok {
+		if _, err := recordFailedAttempt(c, db, keys...); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusUnauthorized, ErrorResponse{"This two-factor authentication code is invalid.", "totp-invalid"})
+		return false
+	}
+
+	return true
+}
+
+// newRecoveryCodes replaces the recovery codes of the user, returning the new
+// ones in clear: they are shown only once.
+func newRecoveryCodes(ctx context.Context, db bun.IDB, key []byte, userID string) ([]string, error) {
+	codes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.NewDelete().Table("recovery_codes").Where("user_id = ?", userID).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	recoveryCodes := make([]*RecoveryCode, 0, len(codes))
+	for _, code := range codes {
+		recoveryCodes = append(recoveryCodes, &RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashRecoveryCode(key, code),
+		})
+	}
+
+	if _, err := db.NewInsert().Model(&recoveryCodes).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func registerTOTPRoutes(authorized *gin.RouterGroup, db *bun.DB, key []byte) {
+	selectUser := func(c *gin.Context) (*User, bool) {
+		user := new(User)
+		if err := db.NewSelect().Model(user).Where("id = ?", c.GetString("userID")).Scan(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return nil, false
+		}
+
+		return user, true
+	}
+
+	authorized.GET("/users/me/totp", func(c *gin.Context) {
+		user, ok := selectUser(c)
+		if !ok {
+			return
+		}
+
+		recoveryCodes, err := db.NewSelect().Table("recovery_codes").Where("user_id = ?", user.ID).Where("used_at IS NULL").Count(c)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":       user.TOTPEnabledAt != nil,
+			"enabledAt":     user.TOTPEnabledAt,
+			"required":      isStaff(user),
+			"recoveryCodes": recoveryCodes,
+		})
+	})
+
+	// Enrolment starts with a new secret, which is only enabled once the
+	// member proves their authenticator app generates the right codes.
+	authorized.POST("/users/me/totp", func(c *gin.Context) {
+		var json StartTOTPRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user, ok := selectUser(c)
+		if !ok {
+			return
+		}
+
+		accountKey := accountThrottleKey("totp", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		if user.TOTPEnabledAt != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Two-factor authentication is already enabled.", "totp-enabled"})
+			return
+		}
+
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		update := &User{ID: user.ID, TOTPSecret: &secret}
+		if _, err := db.NewUpdate().Model(update).Column("totp_secret", "totp_last_step").WherePK().Exec(c); err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"secret": secret,
+			"uri":    auth.TOTPURI(totpIssuer, user.Email, secret),
+		})
+	})
+
+	// Confirming enables two-factor authentication and upgrades the current
+	// session, so that refreshing it gives a token valid for admin routes.
+	authorized.POST("/users/me/totp/confirm", func(c *gin.Context) {
+		var json TOTPCodeRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user, ok := selectUser(c)
+		if !ok {
+			return
+		}
+
+		if user.TOTPEnabledAt != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Two-factor authentication is already enabled.", "totp-enabled"})
+			return
+		}
+		if user.TOTPSecret == nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Two-factor authentication enrolment was not started.", "totp-not-started"})
+			return
+		}
+
+		ipKey := ipThrottleKey(c)
+		accountKey := accountThrottleKey("totp", user.ID)
+		if !checkThrottle(c, db, accountKey, ipKey) {
+			return
+		}
+
+		var codes []string
+		err := db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			ok, err := useTOTPCode(ctx, tx, user, json.Code)
+			if err != nil || !ok {
+				return err
+			}
+
+			now := time.Now()
+			update := &User{ID: user.ID, TOTPEnabledAt: &now}
+			if _, err := tx.NewUpdate().Model(update).Column("totp_enabled_at").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+			user.TOTPEnabledAt = &now
+
+			codes, err = newRecoveryCodes(ctx, tx, key, user.ID)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.NewUpdate().Table("sessions").Set("mfa = TRUE").Where("id = ?", c.GetString("sessionID")).Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, user.ID, c.ClientIP(), "totp.enable", "user", user.ID, nil)
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if user.TOTPEnabledAt == nil {
+			if _, err := recordFailedAttempt(c, db, accountKey, ipKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This two-factor authentication code is invalid.", "totp-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+	})
+
+	// New recovery codes void the previous ones: the password is asked again,
+	// as a stolen token is not enough to lock the member out.
+	authorized.POST("/users/me/totp/recovery-codes", func(c *gin.Context) {
+		var json RegenerateRecoveryCodesRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user, ok := selectUser(c)
+		if !ok {
+			return
+		}
+
+		if user.TOTPEnabledAt == nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Two-factor authentication is not enabled.", "totp-disabled"})
+			return
+		}
+
+		ipKey := ipThrottleKey(c)
+		accountKey := accountThrottleKey("totp", user.ID)
+		if !checkThrottle(c, db, accountKey, ipKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey, ipKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		ok, err := useTOTPCode(c, db, user, json.Code)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if !ok {
+			if _, err := recordFailedAttempt(c, db, accountKey, ipKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This two-factor authentication code is invalid.", "totp-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		codes, err := newRecoveryCodes(c, db, key, user.ID)
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		if err := writeAudit(c, db, user.ID, c.ClientIP(), "totp.recovery-codes", "user", user.ID, nil); err != nil {
+			log.Println(err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+	})
+
+	authorized.DELETE("/users/me/totp", func(c *gin.Context) {
+		var json DisableTOTPRequest
+		if err := c.ShouldBindJSON(&json); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{err.Error(), "bad-request"})
+			return
+		}
+
+		user, ok := selectUser(c)
+		if !ok {
+			return
+		}
+
+		if isStaff(user) {
+			c.JSON(http.StatusForbidden, ErrorResponse{"Two-factor authentication is mandatory for admins.", "totp-mandatory"})
+			return
+		}
+
+		if user.TOTPEnabledAt == nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{"Two-factor authentication is not enabled.", "totp-disabled"})
+			return
+		}
+
+		accountKey := accountThrottleKey("totp", user.ID)
+		if !checkThrottle(c, db, accountKey) {
+			return
+		}
+
+		if !auth.CheckPassword(json.Password, user.Password) {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This password is invalid.", "password-invalid"})
+			return
+		}
+
+		ok, err := useTOTPCode(c, db, user, json.Code)
+		if err == nil && !ok {
+			ok, err = useRecoveryCode(c, db, key, user, json.Code)
+		}
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+		if !ok {
+			if _, err := recordFailedAttempt(c, db, accountKey); err != nil {
+				log.Println(err)
+			}
+
+			c.JSON(http.StatusBadRequest, ErrorResponse{"This two-factor authentication code is invalid.", "totp-invalid"})
+			return
+		}
+
+		if err := clearFailedAttempts(c, db, accountKey); err != nil {
+			log.Println(err)
+		}
+
+		err = db.RunInTx(c, nil, func(ctx context.Context, tx bun.Tx) error {
+			update := &User{ID: user.ID}
+			if _, err := tx.NewUpdate().Model(update).Column("totp_secret", "totp_enabled_at", "totp_last_step").WherePK().Exec(ctx); err != nil {
+				return err
+			}
+
+			if _, err := tx.NewDelete().Table("recovery_codes").Where("user_id = ?", user.ID).Exec(ctx); err != nil {
+				return err
+			}
+
+			if _, err := tx.NewUpdate().Table("sessions").Set("mfa = FALSE").Where("user_id = ?", user.ID).Exec(ctx); err != nil {
+				return err
+			}
+
+			return writeAudit(ctx, tx, user.ID, c.ClientIP(), "totp.disable", "user", user.ID, nil)
+		})
+		if err != nil {
+			log.Println(err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{"Internal server error.", "internal"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{})
+	})
+}
@@ -1,4 +1,5 @@
-import auth from "./auth";
+import { get as getStore } from "svelte/store";
+import auth, { isImpersonating } from "./auth";
 
 export let baseURL = "http://localhost:8080/";
 
@@ -20,12 +21,74 @@ function camelCasedObject(object: any): any {
   return newObject;
 }
 
+let refreshing: Promise<boolean> | null = null;
+
+// refresh shares one refresh between the calls failing together: a refresh
+// token is only valid once, and using it twice revokes the session.
+export function refresh(): Promise<boolean> {
+  if (!refreshing) {
+    refreshing = lockRefresh(auth.getRefreshToken()).finally(() => {
+      refreshing = null;
+    });
+  }
+
+  return refreshing;
+}
+
+// lockRefresh shares the refresh between the tabs too, when the browser
+// supports locks: a tab waiting for another one uses the tokens it got.
+async function lockRefresh(refreshToken: string | null): Promise<boolean> {
+  if (!navigator.locks) {
+    return await refreshTokens();
+  }
+
+  return await navigator.locks.request("refresh", async () => {
+    if (auth.getRefreshToken() !== refreshToken) {
+      const token = localStorage.getItem("token");
+      if (token) {
+        auth.token.set(token);
+      }
+
+      return token !== null;
+    }
+
+    return await refreshTokens();
+  });
+}
+
+async function refreshTokens(): Promise<boolean> {
+  const refreshToken = auth.getRefreshToken();
+
+  if (!refreshToken) {
+    return false;
+  }
+
+  const response = await fetch(baseURL + "tokens/refresh", {
+    method: "POST",
+    cache: "no-cache",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ refresh_token: refreshToken }),
+  });
+
+  if (!response.ok) {
+    return false;
+  }
+
+  const { token, refreshToken: newRefreshToken } = await response.json();
+  auth.setToken(token, newRefreshToken);
+
+  return true;
+}
+
 async function call(
   method: string,
   path: string,
   headers: any,
-  body?: string | FormData
-) {
+  body?: string | FormData,
+  retry = true
+): Promise<any> {
   const currentToken = auth.getToken();
 
   if (currentToken) {
@@ -45,7 +108,15 @@ async function call(
   const json = await response.json();
 
   if (!response.ok) {
-    if (json.code === "token-expired" || json.code === "token-invalid") {
+    if (json.code === "token-expired" && retry && (await refresh())) {
+      return await call(method, path, headers, body, false);
+    }
+
+    if (
+      json.code === "token-expired" ||
+      json.code === "token-invalid" ||
+      json.code === "session-revoked"
+    ) {
       auth.signOut();
     }
 
@@ -55,7 +126,7 @@ async function call(
   return json;
 }
 
-async function post(path: string, data: any) {
+export async function post(path: string, data: any) {
   const headers = {
     "Content-Type": "application/json",
   };
@@ -65,6 +136,34 @@ async function post(path: string, data: any) {
   return await call("POST", path, headers, body);
 }
 
+async function patch(path: string, data: any) {
+  const headers = {
+    "Content-Type": "application/json",
+  };
+
+  const body = JSON.stringify(camelCasedObject(data));
+
+  return await call("PATCH", path, headers, body);
+}
+
+async function put(path: string, data: any) {
+  const headers = {
+    "Content-Type": "application/json",
+  };
+
+  const body = JSON.stringify(camelCasedObject(data));
+
+  return await call("PUT", path, headers, body);
+}
+
+async function del(path: string) {
+  const headers = {
+    "Content-Type": "application/json",
+  };
+
+  return await call("DELETE", path, headers);
+}
+
 async function upload(path: string, body: FormData) {
   const headers = {};
 
@@ -91,12 +190,24 @@ interface CreateUserRequest {
   country: string;
   category: string;
   reason: string | null;
+  giftCode?: string | null;
 }
 
 export async function createUser(user: CreateUserRequest) {
   return await post("users", user);
 }
 
+interface CheckPasswordRequest {
+  password: string;
+  email?: string;
+  firstName?: string;
+  lastName?: string;
+}
+
+export async function checkPassword(data: CheckPasswordRequest) {
+  return await post("passwords/check", data);
+}
+
 interface ConfirmUserRequest {
   email: string;
   token: string;
@@ -118,12 +229,34 @@ interface ResetUserRequest {
   email: string;
   password: string;
   token: string;
+  totpCode?: string;
+  recoveryCode?: string;
 }
 
 export async function resetUser(data: ResetUserRequest) {
   return await post("users/reset", data);
 }
 
+interface StartLoginLinkRequest {
+  email: string;
+}
+
+export async function startLoginLink(data: StartLoginLinkRequest) {
+  return await post("users/login-link/start", data);
+}
+
+interface LoginLinkRequest {
+  id: string;
+  expires: number;
+  signature: string;
+  totpCode?: string;
+  recoveryCode?: string;
+}
+
+export async function loginWithLink(data: LoginLinkRequest) {
+  return await post("users/login-link", data);
+}
+
 interface StartConfirmUserRequest {
   email: string;
 }
@@ -133,8 +266,27 @@ export async function startConfirmUser(data: StartConfirmUserRequest) {
 }
 
 interface CreateTokenRequest {
-  email: string;
-  password: string;
+  email?: string;
+  password?: string;
+  totpCode?: string;
+  recoveryCode?: string;
+  passkey?: any;
+}
+
+// secondFactor sends a code given by the member either as a TOTP code or as a
+// recovery code, depending on its shape.
+export function secondFactor(code: string) {
+  code = code.replace(/\s/g, "");
+
+  if (code === "") {
+    return {};
+  }
+
+  if (/^\d{6}$/.test(code)) {
+    return { totpCode: code };
+  }
+
+  return { recoveryCode: code };
 }
 
 export async function createToken(credentials: CreateTokenRequest) {
@@ -144,6 +296,8 @@ export async function createToken(credentials: CreateTokenRequest) {
 interface CreateCheckoutSessionRequest {
   quantity: number;
   gift?: boolean;
+  giftTemplate?: string;
+  giftLanguage?: string;
 }
 
 export async function createCheckoutSession(
@@ -152,6 +306,10 @@ export async function createCheckoutSession(
   return await post("users/me/checkout/sessions", data);
 }
 
+export async function getGiftTemplates() {
+  return await get("gift-templates");
+}
+
 interface UseGiftCodeRequest {
   giftCode: string;
 }
@@ -164,14 +322,183 @@ export async function getCurrentUser() {
   return await get("users/me");
 }
 
+export async function getTOTP() {
+  return await get("users/me/totp");
+}
+
+interface StartTOTPRequest {
+  password: string;
+}
+
+export async function startTOTP(data: StartTOTPRequest) {
+  return await post("users/me/totp", data);
+}
+
+interface ConfirmTOTPRequest {
+  code: string;
+}
+
+export async function confirmTOTP(data: ConfirmTOTPRequest) {
+  return await post("users/me/totp/confirm", data);
+}
+
+interface StartEmailChangeRequest {
+  email: string;
+  password: string;
+}
+
+export async function startEmailChange(data: StartEmailChangeRequest) {
+  return await post("users/me/email", data);
+}
+
+interface ConfirmEmailChangeRequest {
+  token: string;
+}
+
+export async function confirmEmailChange(data: ConfirmEmailChangeRequest) {
+  return await post("users/me/email/confirm", data);
+}
+
+interface UpdateProfileRequest {
+  phoneNumber?: string;
+  firstName?: string;
+  lastName?: string;
+  address?: string;
+  postalCode?: string;
+  city?: string;
+  country?: string;
+}
+
+export async function updateProfile(data: UpdateProfileRequest) {
+  return await patch("users/me", data);
+}
+
+export async function getDataExport() {
+  return await get("users/me/export");
+}
+
+interface RequestErasureRequest {
+  password: string;
+}
+
+export async function requestErasure(data: RequestErasureRequest) {
+  return await post("users/me/erasure", data);
+}
+
+export async function getSessions() {
+  return await get("users/me/sessions");
+}
+
+export async function revokeSession(sessionID: string) {
+  return await del(`users/me/sessions/${sessionID}`);
+}
+
+export async function revokeSessions() {
+  return await del("users/me/sessions");
+}
+
+// signOut revokes the session before forgetting its tokens, so that the
+// refresh token cannot be used anymore.
+export async function signOut() {
+  if (!getStore(isImpersonating)) {
+    try {
+      await revokeSession("current");
+    } catch (error) {
+      // The tokens are forgotten anyway.
+    }
+  }
+
+  auth.signOut();
+}
+
+export async function getPasskeys() {
+  return await get("users/me/passkeys");
+}
+
+interface RenamePasskeyRequest {
+  passkeyID: string;
+  name: string;
+}
+
+export async function renamePasskey({ passkeyID, name }: RenamePasskeyRequest) {
+  return await patch(`users/me/passkeys/${passkeyID}`, { name });
+}
+
+export async function deletePasskey(passkeyID: string) {
+  return await del(`users/me/passkeys/${passkeyID}`);
+}
+
 export async function getUser(userID: string) {
   return await get(`admin/users/${userID}`);
 }
 
+export async function getRoles() {
+  return await get("admin/roles");
+}
+
+interface UpdateUserRolesRequest {
+  userID: string;
+  roles: string[];
+}
+
+export async function updateUserRoles({ userID, roles }: UpdateUserRolesRequest) {
+  return await put(`admin/users/${userID}/roles`, { roles });
+}
+
+export async function impersonateUser(userID: string) {
+  return await post(`admin/users/${userID}/impersonate`, {});
+}
+
+export async function endImpersonation(sessionID: string) {
+  return await del(`admin/impersonations/${sessionID}`);
+}
+
+export async function getErasurePreview(userID: string) {
+  return await get(`admin/users/${userID}/erasure`);
+}
+
+export async function eraseUser(userID: string) {
+  return await post(`admin/users/${userID}/erasure`, {});
+}
+
+export async function getAuditLog(filters: Record<string, string>) {
+  const query = new URLSearchParams(
+    Object.entries(filters).filter(([, value]) => value !== "")
+  );
+
+  return await get(`admin/audit?${query}`);
+}
+
 export async function getUsers() {
   return await get("admin/users");
 }
 
+export async function getAPIKeys() {
+  return await get("admin/api-keys");
+}
+
+interface CreateAPIKeyRequest {
+  name: string;
+  scopes: string[];
+  expiresAt: string | null;
+}
+
+export async function createAPIKey(data: CreateAPIKeyRequest) {
+  return await post("admin/api-keys", data);
+}
+
+export async function revokeAPIKey(apiKeyID: string) {
+  return await del(`admin/api-keys/${apiKeyID}`);
+}
+
 export async function uploadDocuments(body: FormData) {
   return await upload("users/me/documents", body);
 }
+
+export async function getOAuthClient(clientID: string) {
+  return await get(`oauth/clients/${encodeURIComponent(clientID)}`);
+}
+
+export async function authorizeOAuth(query: Record<string, string>) {
+  return await post("oauth/authorize", query);
+}
@@ -5,7 +5,9 @@ import * as Sentry from "@sentry/browser";
 
 interface JwtPayload {
   user_id: string;
-  admin: string;
+  permissions: string[] | null;
+  mfa: boolean;
+  impersonator_id?: string;
 }
 
 let currentToken: string | null;
@@ -14,9 +16,21 @@ export const token = writable<string | null>(localStorage.getItem("token"));
 const decodedToken = derived(token, ($token) =>
   $token ? jwtDecode<JwtPayload>($token) : null
 );
+export const permissions = derived(
+  decodedToken,
+  ($decodedToken) => $decodedToken?.permissions ?? []
+);
 export const isAdmin = derived(
+  permissions,
+  ($permissions) => $permissions.length > 0
+);
+export const isImpersonating = derived(
   decodedToken,
-  ($decodedToken) => $decodedToken?.admin
+  ($decodedToken) => !!$decodedToken?.impersonator_id
+);
+export const hasMFA = derived(
+  decodedToken,
+  ($decodedToken) => $decodedToken?.mfa
 );
 
 token.subscribe((value) => {
@@ -29,6 +43,14 @@ token.subscribe((value) => {
   currentToken = value;
 });
 
+// The tokens are shared between the tabs: when another tab refreshes them or
+// signs out, this one follows.
+window.addEventListener("storage", (event) => {
+  if (event.storageArea === localStorage && event.key === "token") {
+    token.set(event.newValue);
+  }
+});
+
 if (import.meta.env.PROD) {
   decodedToken.subscribe((value) => {
     if (value === null) {
@@ -43,18 +65,70 @@ export function getToken(): string | null {
   return currentToken;
 }
 
-export function setToken(newToken: string) {
+// getRefreshToken reads the refresh token from the storage every time, as
+// another tab may have rotated it.
+export function getRefreshToken(): string | null {
+  return localStorage.getItem("refreshToken");
+}
+
+export function setToken(newToken: string, newRefreshToken?: string) {
+  if (newRefreshToken) {
+    localStorage.setItem("refreshToken", newRefreshToken);
+  }
+
+  token.set(newToken);
+}
+
+// impersonate keeps the tokens of the admin aside while they see the app as a
+// member.
+export function impersonate(newToken: string, sessionID: string) {
+  localStorage.setItem("impersonatorToken", currentToken ?? "");
+  localStorage.setItem(
+    "impersonatorRefreshToken",
+    localStorage.getItem("refreshToken") ?? ""
+  );
+  localStorage.setItem("impersonationSessionID", sessionID);
+
+  localStorage.removeItem("refreshToken");
   token.set(newToken);
+  router.goto("/");
+}
+
+// stopImpersonating gives the admin their tokens back, returning the ID of the
+// impersonation session.
+export function stopImpersonating(): string | null {
+  const sessionID = localStorage.getItem("impersonationSessionID");
+
+  setToken(
+    localStorage.getItem("impersonatorToken") ?? "",
+    localStorage.getItem("impersonatorRefreshToken") ?? undefined
+  );
+
+  localStorage.removeItem("impersonatorToken");
+  localStorage.removeItem("impersonatorRefreshToken");
+  localStorage.removeItem("impersonationSessionID");
+
+  return sessionID;
 }
 
 export function signOut() {
+  if (localStorage.getItem("impersonatorToken") !== null) {
+    stopImpersonating();
+    router.goto("/admin");
+    return;
+  }
+
+  localStorage.removeItem("refreshToken");
   token.set(null);
   router.goto("/");
 }
 
 export default {
   getToken,
+  getRefreshToken,
   setToken,
   token,
   signOut,
+  impersonate,
+  stopImpersonating,
 };
@@ -0,0 +1,28 @@
+import toast from "./toast";
+
+const giftErrors: Record<string, string> = {
+  "not-found": "Ce code cadeau n'existe pas.",
+  "gift-not-paid": "Ce cadeau n'a pas encore été payé.",
+  "gift-code-claimed": "Ce code cadeau a déjà été utilisé.",
+  "gift-code-expired": "Ce code cadeau a expiré.",
+  "gift-self-claim": "Vous ne pouvez pas utiliser votre propre cadeau.",
+};
+
+interface GiftOutcome {
+  giftShares?: number;
+  giftError?: string;
+}
+
+// showGiftOutcome tells the member what became of the gift code given at
+// sign-up, which is claimed when their account is confirmed.
+export function showGiftOutcome({ giftShares, giftError }: GiftOutcome) {
+  if (giftShares === 1) {
+    toast.success("Une part sociale vous a été offerte !");
+  } else if (giftShares) {
+    toast.success(`${giftShares} parts sociales vous ont été offertes !`);
+  } else if (giftError) {
+    toast.error(
+      giftErrors[giftError] ?? "Votre code cadeau n'a pas pu être utilisé."
+    );
+  }
+}
@@ -0,0 +1,107 @@
+import { post } from "./api";
+
+function decode(value: string): ArrayBuffer {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, "="));
+
+  return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer;
+}
+
+function encode(value: ArrayBuffer | null): string | null {
+  if (value === null) {
+    return null;
+  }
+
+  const binary = String.fromCharCode(...new Uint8Array(value));
+
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=/g, "");
+}
+
+function decodeDescriptors(descriptors?: any[]) {
+  return descriptors?.map((descriptor) => ({
+    ...descriptor,
+    id: decode(descriptor.id),
+  }));
+}
+
+export function passkeysSupported(): boolean {
+  return window.PublicKeyCredential !== undefined;
+}
+
+interface CreatePasskeyRequest {
+  name: string;
+  password: string;
+  totpCode?: string;
+  recoveryCode?: string;
+}
+
+export async function createPasskey({
+  name,
+  ...credentials
+}: CreatePasskeyRequest) {
+  const { challengeId, options } = await post(
+    "users/me/passkeys/registration/start",
+    credentials
+  );
+
+  const credential = (await navigator.credentials.create({
+    publicKey: {
+      ...options.publicKey,
+      challenge: decode(options.publicKey.challenge),
+      user: {
+        ...options.publicKey.user,
+        id: decode(options.publicKey.user.id),
+      },
+      excludeCredentials: decodeDescriptors(
+        options.publicKey.excludeCredentials
+      ),
+    },
+  })) as PublicKeyCredential;
+
+  const response = credential.response as AuthenticatorAttestationResponse;
+
+  return await post("users/me/passkeys/registration/finish", {
+    challengeId,
+    name,
+    credential: {
+      id: credential.id,
+      rawId: encode(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: encode(response.clientDataJSON),
+        attestationObject: encode(response.attestationObject),
+      },
+    },
+  });
+}
+
+// getPasskeyAssertion asks the browser for one of the passkeys of the site,
+// returning the assertion to send to POST /tokens.
+export async function getPasskeyAssertion() {
+  const { challengeId, options } = await post("passkeys/login/start", {});
+
+  const credential = (await navigator.credentials.get({
+    publicKey: {
+      ...options.publicKey,
+      challenge: decode(options.publicKey.challenge),
+      allowCredentials: decodeDescriptors(options.publicKey.allowCredentials),
+    },
+  })) as PublicKeyCredential;
+
+  const response = credential.response as AuthenticatorAssertionResponse;
+
+  return {
+    challenge_id: challengeId,
+    credential: {
+      id: credential.id,
+      rawId: encode(credential.rawId),
+      type: credential.type,
+      response: {
+        clientDataJSON: encode(response.clientDataJSON),
+        authenticatorData: encode(response.authenticatorData),
+        signature: encode(response.signature),
+        userHandle: encode(response.userHandle),
+      },
+    },
+  };
+}
@@ -0,0 +1,16 @@
+export const passwordFeedback: Record<string, string> = {
+  "password-too-short": "Le mot de passe doit contenir au moins 10 caractères.",
+  "password-too-long": "Le mot de passe est trop long.",
+  "password-common": "Ce mot de passe fait partie des plus utilisés.",
+  "password-personal":
+    "Le mot de passe ne doit pas contenir votre nom ou votre adresse email.",
+  "password-sequence":
+    "Évitez les suites de caractères comme « 1234 » ou « azerty ».",
+  "password-repetitive": "Évitez les répétitions comme « aaa » ou « abcabc ».",
+  "password-weak":
+    "Ce mot de passe est trop facile à deviner : ajoutez quelques mots.",
+};
+
+export function passwordFeedbackMessages(feedback: string[]): string[] {
+  return feedback.map((code) => passwordFeedback[code] ?? code);
+}